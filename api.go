@@ -7,10 +7,16 @@
 
 			It allows for CRUD actions on the database through the following routes and methods:
 				/api/members         GET    - returns all members in the database
+				/api/members/search  GET    - returns the members matching the words in ?q=, most relevant first
 				/api/members/{id}  GET    - returns a specific member in the database with the provided ID
 				/api/members         POST   - adds a new member to the database
+				/api/members:batch   POST   - adds many members at once, with a result for each of them
 				/api/members/{id}  PATCH  - updates information for a member with the provided clid
+				/api/members         PATCH  - updates every member that passes the filters in the query string
+				/api/members/{id}  PUT    - replaces the member with the provided clid, or creates it when upserting
 				/api/members/{id}  DELETE - deletes information for a member with the provided clid
+				/api/members         DELETE - deletes every member, or those that pass the filters in the query string
+				/api/ready           GET    - reports whether the member store is connected
 
 			A working demonstration of this API is hosted at fuchsli.com on port 8081
 
@@ -23,16 +29,16 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"fmt"
+	"encoding/json"
+	"flag"
 	"log"
 	"net/http"
+	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 // Member Struct
@@ -44,17 +50,64 @@ type Member struct {
 	Role      string   `json:"role,omitempty" bson:"role,omitempty"`
 	Duration  string   `json:"duration,omitempty" bson:"duration,omitempty"`
 	Tags      []string `json:"tags" bson:"tags"`
+	// Set by the store and raised by one on every change; sent to clients as the ETag
+	Version int64 `json:"version" bson:"version"`
+	// Set by the store on every change; sent to clients as Last-Modified rather than in the body
+	Modified time.Time `json:"-" bson:"modified"`
 }
 
-// Global variables
-var (
-	members    []Member
-	collection *mongo.Collection
-)
+// Holds the dependencies shared by the route handlers
+type server struct {
+	store MemberStore
+	// Creates the IDs of new members
+	ids idGenerator
+	// Set once the store can be used; until then member routes answer 503
+	ready atomic.Bool
+	// Whether a body with fields a member does not have is refused rather than having them dropped
+	rejectUnknownFields bool
+}
+
+// Create a server. A nil store leaves the server not ready until setStore is called.
+func newServer(store MemberStore, ids idGenerator) *server {
+	s := &server{ids: ids}
+	if store != nil {
+		s.setStore(store)
+	}
+	return s
+}
+
+// Provide the store once it is connected and mark the server ready
+func (s *server) setStore(store MemberStore) {
+	s.store = store
+	s.ready.Store(true)
+}
+
+// Answer 503 on the wrapped routes while the store is still connecting
+func (s *server) requireReady(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.ready.Load() {
+			w.Header().Set("Retry-After", "5")
+			writeProblem(w, http.StatusServiceUnavailable, codeUnavailable, "The member store is not ready yet")
+			return
+		}
+		h(w, r)
+	}
+}
 
-func redirectTLS(w http.ResponseWriter, r *http.Request) {
-	domain := "fuchsli.com"
-	http.Redirect(w, r, "https://"+domain+r.RequestURI, http.StatusMovedPermanently)
+// Report whether the server can handle member requests
+func (s *server) getReady(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !s.ready.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]bool{"ready": s.ready.Load()})
+}
+
+// Redirect plain HTTP requests to HTTPS on the provided domain
+func redirectTLS(domain string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://"+domain+r.RequestURI, http.StatusMovedPermanently)
+	}
 }
 
 func redirectWWW(h http.Handler) http.Handler {
@@ -73,50 +126,88 @@ func redirectWWW(h http.Handler) http.Handler {
 	})
 }
 
-// Connect to MongoDB
-func init() {
-	// Create a MongoDB Connection on Port 27017
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// Create the router with the route handlers bound to the server
+func newRouter(s *server) *mux.Router {
+	// Initialize router
+	r := mux.NewRouter()
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
-	handleError(err)
+	// Route Handlers / Endpoints
+	r.HandleFunc("/api/ready", s.getReady).Methods("GET")
+	r.HandleFunc("/api/members", s.requireReady(s.getMembers)).Methods("GET")
+	// Registered before /api/members/{clid}, which would otherwise take "search" for an ID.
+	// memberErrors refuses "search" as a clid, since GET could never find that member.
+	r.HandleFunc("/api/members/search", s.requireReady(s.searchMembers)).Methods("GET")
+	r.HandleFunc("/api/members/{clid}", s.requireReady(s.getMember)).Methods("GET")
+	r.HandleFunc("/api/members", s.requireReady(s.createMember)).Methods("POST")
+	r.HandleFunc("/api/members:batch", s.requireReady(s.createMembers)).Methods("POST")
+	r.HandleFunc("/api/members/{clid}", s.requireReady(s.updateMember)).Methods("PATCH")
+	r.HandleFunc("/api/members", s.requireReady(s.updateMembers)).Methods("PATCH")
+	r.HandleFunc("/api/members/{clid}", s.requireReady(s.replaceMember)).Methods("PUT")
+	r.HandleFunc("/api/members/{clid}", s.requireReady(s.deleteMember)).Methods("DELETE")
+	r.HandleFunc("/api/members", s.requireReady(s.deleteMembers)).Methods("DELETE")
+
+	// Unknown paths and methods get problems like every other failed request
+	r.NotFoundHandler = http.HandlerFunc(routeNotFound)
+	r.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+	return r
+}
 
-	ctx, _ = context.WithTimeout(context.Background(), 2*time.Second)
-	err = client.Ping(ctx, readpref.Primary())
+func main() {
+	cfg, err := loadConfig(os.Args[1:], os.LookupEnv)
+	if err == flag.ErrHelp {
+		return
+	}
 	handleError(err)
 
-	fmt.Println("Connected to MongoDB")
-	collection = client.Database("go-api").Collection("members")
-}
+	ids, err := newIDGenerator(cfg.IDGenerator)
+	handleError(err)
+	s := newServer(nil, ids)
+	s.rejectUnknownFields = cfg.UnknownFields == "reject"
 
-func main() {
+	// Generators that continue from the stored IDs see them before the server is ready
+	start := func(store MemberStore) {
+		handleError(seedIDs(context.Background(), ids, store))
+		s.setStore(store)
+	}
 
-	certfile := "/etc/letsencrypt/live/fuchsli.com-0003/fullchain.pem"
-	privkey := "/etc/letsencrypt/live/fuchsli.com-0003/privkey.pem"
+	switch cfg.Store {
+	case "mongo":
+		// Mongo may come up after the API, so connect in the background and report readiness until then
+		go func() {
+			store, err := connectMongoStore(context.Background(), cfg.Mongo, defaultBackoff)
+			handleError(err)
+			start(store)
+		}()
+	case "sqlite":
+		store, err := openSQLiteStore(context.Background(), cfg.SQLite.Path)
+		handleError(err)
+		start(store)
+	case "postgres":
+		store, err := openPostgresStore(context.Background(), cfg.Postgres.URL)
+		handleError(err)
+		start(store)
+	case "memory":
+		start(newMemoryStore())
+	}
 
-	// Initialize router
-	r := mux.NewRouter()
+	r := newRouter(s)
 
-	// Route Handlers / Endpoints
-	r.HandleFunc("/api/members", getMembers).Methods("GET")
-	r.HandleFunc("/api/members/{id}", getMember).Methods("GET")
-	r.HandleFunc("/api/members", createMember).Methods("POST")
-	r.HandleFunc("/api/members/{id}", updateMember).Methods("PATCH")
-	r.HandleFunc("/api/members/{id}", deleteMember).Methods("DELETE")
-	r.HandleFunc("/api/members", deleteMembers).Methods("DELETE")
+	// Without a certificate there is nothing to redirect to, so serve plain HTTP
+	if !cfg.TLS() {
+		log.Fatal(http.ListenAndServe(cfg.HTTP.Addr, r))
+	}
 
 	go func() {
-		if err := http.ListenAndServe(":8082", http.HandlerFunc(redirectTLS)); err != nil {
+		if err := http.ListenAndServe(cfg.HTTP.RedirectAddr, redirectTLS(cfg.HTTP.Domain)); err != nil {
 			log.Fatalf("ListenAndServe error: %v", err)
 		}
 	}()
 
 	config := &tls.Config{MinVersion: tls.VersionTLS10}
 	server := &http.Server{
-		Addr:      ":8081",
+		Addr:      cfg.HTTP.Addr,
 		Handler:   redirectWWW(r),
 		TLSConfig: config,
 	}
-	log.Fatal(server.ListenAndServeTLS(certfile, privkey))
+	log.Fatal(server.ListenAndServeTLS(cfg.HTTP.CertFile, cfg.HTTP.KeyFile))
 }
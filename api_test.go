@@ -3,8 +3,7 @@
 
 		A demo implementation of a CRUD API
 
-		! Important:
-			Never test on a production database. Testing will empty the mongo collection completely. Bad things will happen.
+		The tests run against an in-memory store, so no MongoDB is needed and no real data is touched.
 */
 
 package main
@@ -12,31 +11,90 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
-	"go.mongodb.org/mongo-driver/bson"
 )
 
+// The server every test runs against
+var testServer = newServer(newMemoryStore(), &uuidV7Generator{})
+
 // Create the router we will use for the tests
 func Router() *mux.Router {
-	// Initialize router
-	r := mux.NewRouter()
+	return newRouter(testServer)
+}
+
+// A server with an empty store of its own, for tests that need an empty collection or change its settings
+func newTestServer() (*server, *mux.Router) {
+	s := newServer(newMemoryStore(), &uuidV7Generator{})
+	return s, newRouter(s)
+}
+
+// Send a request to a router, with headers given as name and value pairs. A header with no name is skipped
+func send(router *mux.Router, method string, path string, body string, headers ...string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		if headers[i] != "" {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// Decode the problem+json body of a failed request
+func readProblem(recorder *httptest.ResponseRecorder) apiError {
+	var problem apiError
+	json.NewDecoder(recorder.Body).Decode(&problem)
+	return problem
+}
+
+// Decode the members of a list response
+func readList(recorder *httptest.ResponseRecorder) []Member {
+	var list struct {
+		Items []Member `json:"items"`
+	}
+	json.NewDecoder(recorder.Body).Decode(&list)
+	return list.Items
+}
+
+// Decode the body of a batch create
+func readBatch(recorder *httptest.ResponseRecorder) batchResponse {
+	var response batchResponse
+	json.NewDecoder(recorder.Body).Decode(&response)
+	return response
+}
+
+// Decode the body of a bulk update or delete
+func readBulk(recorder *httptest.ResponseRecorder) bulkResult {
+	var result bulkResult
+	json.NewDecoder(recorder.Body).Decode(&result)
+	return result
+}
+
+// Read a text body without its trailing newline
+func readText(recorder *httptest.ResponseRecorder) string {
+	return strings.Trim(recorder.Body.String(), "\n")
+}
 
-	// Route Handlers / Endpoints
-	r.HandleFunc("/api/members", getMembers).Methods("GET")
-	r.HandleFunc("/api/members/{clid}", getMember).Methods("GET")
-	r.HandleFunc("/api/members", createMember).Methods("POST")
-	r.HandleFunc("/api/members/{clid}", updateMember).Methods("PATCH")
-	r.HandleFunc("/api/members/{clid}", deleteMember).Methods("DELETE")
-	r.HandleFunc("/api/members", deleteMembers).Methods("DELETE")
-	return r
+// Decode a member response, leaving out the generated ID so it can be compared
+func readCreated(recorder *httptest.ResponseRecorder) Member {
+	var member Member
+	json.NewDecoder(recorder.Body).Decode(&member)
+	member.ID = ""
+	return member
 }
 
 // Try to empty the DB Collection
@@ -47,8 +105,8 @@ func TestEmptyDB(t *testing.T) {
 	req, _ := http.NewRequest("DELETE", "/api/members", nil)
 	recorder := httptest.NewRecorder()
 	Router().ServeHTTP(recorder, req)
-	expected := "Successfully deleted all members"
-	received := recorder.Body.String()
+	expected := `{"message":"Successfully deleted all members"}`
+	received := strings.Trim(recorder.Body.String(), "\n")
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -64,8 +122,8 @@ func TestGetMembersEmpty(t *testing.T) {
 	req, _ := http.NewRequest("GET", "/api/members", nil)
 	recorder := httptest.NewRecorder()
 	Router().ServeHTTP(recorder, req)
-	expected := "The collection currently has no members."
-	received := recorder.Body.String()
+	expected := `{"items":[],"count":0}`
+	received := strings.Trim(recorder.Body.String(), "\n")
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -84,8 +142,12 @@ func TestAddMemberID(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	Router().ServeHTTP(recorder, req)
 
-	expected := "Created a new member"
-	received := recorder.Body.String()
+	assert.Equal(t, 201, recorder.Code, "They should be the same")
+	assert.Equal(t, "/api/members/1", recorder.Header().Get("Location"), "They should be the same")
+	assert.Equal(t, `"1"`, recorder.Header().Get("ETag"), "They should be the same")
+	assert.Empty(t, recorder.Header().Get("Warning"), "A provided ID that was free should not be warned about")
+	expected := `{"clid":"1","firstname":"Julius","lastname":"Caesar","jobtype":"Employee","role":"Imperator","tags":["He wasn't actually an emperor"],"version":1}`
+	received := strings.Trim(recorder.Body.String(), "\n")
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -102,7 +164,7 @@ func TestGetMemberByID(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	Router().ServeHTTP(recorder, req)
 
-	expected := `{"clid":"1","firstname":"Julius","lastname":"Caesar","jobtype":"Employee","role":"Imperator","tags":["He wasn't actually an emperor"]}`
+	expected := `{"clid":"1","firstname":"Julius","lastname":"Caesar","jobtype":"Employee","role":"Imperator","tags":["He wasn't actually an emperor"],"version":1}`
 	received := recorder.Body.String()
 
 	/*
@@ -113,7 +175,7 @@ func TestGetMemberByID(t *testing.T) {
 
 		respBody, _ := ioutil.ReadAll(resp.Body)
 
-		expected := `{"clid":"1","firstname":"Julius","lastname":"Caesar","jobtype":"Employee","role":"Imperator","tags":["He wasn't actually an emperor"]}`
+		expected := `{"clid":"1","firstname":"Julius","lastname":"Caesar","jobtype":"Employee","role":"Imperator","tags":["He wasn't actually an emperor"],"version":1}`
 		received := string(respBody)
 	*/
 
@@ -135,7 +197,7 @@ func TestGetAllMembers(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	Router().ServeHTTP(recorder, req)
 
-	expected := `[{"clid":"1","firstname":"Julius","lastname":"Caesar","jobtype":"Employee","role":"Imperator","tags":["He wasn't actually an emperor"]}]`
+	expected := `{"items":[{"clid":"1","firstname":"Julius","lastname":"Caesar","jobtype":"Employee","role":"Imperator","tags":["He wasn't actually an emperor"],"version":1}],"count":1}`
 	received := recorder.Body.String()
 	received = strings.Trim(received, "\n")
 
@@ -155,8 +217,8 @@ func TestUpdateFirstName(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	Router().ServeHTTP(recorder, req)
 
-	expected := "Updated first name successfully. "
-	received := recorder.Body.String()
+	expected := `{"clid":"1","firstname":"NotJulius","lastname":"Caesar","jobtype":"Employee","role":"Imperator","tags":["He wasn't actually an emperor"],"version":2}`
+	received := strings.Trim(recorder.Body.String(), "\n")
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -174,8 +236,8 @@ func TestUpdateFirstAndLastName(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	Router().ServeHTTP(recorder, req)
 
-	expected := "Updated first name successfully. Updated last name successfully. "
-	received := recorder.Body.String()
+	expected := `{"clid":"1","firstname":"NotJulius","lastname":"NotCaesar","jobtype":"Employee","role":"Imperator","tags":["He wasn't actually an emperor"],"version":3}`
+	received := strings.Trim(recorder.Body.String(), "\n")
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -193,8 +255,8 @@ func TestUpdateLastName(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	Router().ServeHTTP(recorder, req)
 
-	expected := "Updated last name successfully. "
-	received := recorder.Body.String()
+	expected := `{"clid":"1","firstname":"NotJulius","lastname":"CaesarAgain","jobtype":"Employee","role":"Imperator","tags":["He wasn't actually an emperor"],"version":4}`
+	received := strings.Trim(recorder.Body.String(), "\n")
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -212,8 +274,9 @@ func TestUpdateJobTypeContractorNoDuration(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	Router().ServeHTTP(recorder, req)
 
-	expected := "The contractor job type must have a specified duration."
-	received := recorder.Body.String()
+	expected := "A contractor must have a duration"
+	received := readProblem(recorder).Detail
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -231,8 +294,9 @@ func TestUpdateJobTypeContractorDurationRole(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	Router().ServeHTTP(recorder, req)
 
-	expected := "A contractor cannot have a role."
-	received := recorder.Body.String()
+	expected := "A member cannot have both a role and a duration; A contractor cannot have a role"
+	received := readProblem(recorder).Detail
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -250,8 +314,8 @@ func TestUpdateJobTypeContractorDuration(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	Router().ServeHTTP(recorder, req)
 
-	expected := "Updated member job type to contractor. Updated duration successfully. "
-	received := recorder.Body.String()
+	expected := `{"clid":"1","firstname":"NotJulius","lastname":"CaesarAgain","jobtype":"Contractor","duration":"6 months","tags":["He wasn't actually an emperor"],"version":5}`
+	received := strings.Trim(recorder.Body.String(), "\n")
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -259,6 +323,25 @@ func TestUpdateJobTypeContractorDuration(t *testing.T) {
 	}
 }
 
+// Try an update where only some of the fields are valid
+func TestUpdatePartiallyValid(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing an update with a valid first name and an invalid role")
+
+	testData := []byte(`{"firstname":"Partial","role":"Executive"}`)
+	req, _ := http.NewRequest("PATCH", "/api/members/1", bytes.NewBuffer(testData))
+	recorder := httptest.NewRecorder()
+	Router().ServeHTTP(recorder, req)
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
+
+	// The valid first name must not have been saved either
+	member, _ := testServer.store.Get(context.Background(), "1")
+	ok := assert.Equal(t, "NotJulius", member.FirstName, "They should be the same")
+	if ok {
+		fmt.Println("Successfully rejected the whole update")
+	}
+}
+
 // Try updating a member to 'employee' without a role
 func TestUpdateJobTypeEmployeeNoRole(t *testing.T) {
 	fmt.Println("----------------")
@@ -269,8 +352,9 @@ func TestUpdateJobTypeEmployeeNoRole(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	Router().ServeHTTP(recorder, req)
 
-	expected := "The employee job type must have a specified role."
-	received := recorder.Body.String()
+	expected := "An employee must have a role"
+	received := readProblem(recorder).Detail
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -288,8 +372,8 @@ func TestUpdateJobTypeEmployeeRole(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	Router().ServeHTTP(recorder, req)
 
-	expected := "Updated member job type to employee. Updated role successfully. "
-	received := recorder.Body.String()
+	expected := `{"clid":"1","firstname":"NotJulius","lastname":"CaesarAgain","jobtype":"Employee","role":"Mastermind","tags":["He wasn't actually an emperor"],"version":6}`
+	received := strings.Trim(recorder.Body.String(), "\n")
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -308,7 +392,8 @@ func TestUpdateEmployeeNoJobTypeOnlyRole(t *testing.T) {
 	Router().ServeHTTP(recorder, req)
 
 	expected := "To set a role, please also include a job type of employee."
-	received := recorder.Body.String()
+	received := readProblem(recorder).Detail
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -327,7 +412,8 @@ func TestUpdateEmployeeDuration(t *testing.T) {
 	Router().ServeHTTP(recorder, req)
 
 	expected := "To set a duration, please also include a job type of contractor."
-	received := recorder.Body.String()
+	received := readProblem(recorder).Detail
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -345,8 +431,8 @@ func TestUpdateFnameLnameJobTypeDuration(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	Router().ServeHTTP(recorder, req)
 
-	expected := "Updated first name successfully. Updated last name successfully. Updated member job type to contractor. Updated duration successfully. "
-	received := recorder.Body.String()
+	expected := `{"clid":"1","firstname":"Johnny","lastname":"Nolastname","jobtype":"contractor","duration":"2 years","tags":["He wasn't actually an emperor"],"version":7}`
+	received := strings.Trim(recorder.Body.String(), "\n")
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -364,8 +450,8 @@ func TestUpdateTags(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	Router().ServeHTTP(recorder, req)
 
-	expected := "Updated tags successfully. "
-	received := recorder.Body.String()
+	expected := `{"clid":"1","firstname":"Johnny","lastname":"Nolastname","jobtype":"contractor","duration":"2 years","tags":["Emperor","Really Cool Guy"],"version":8}`
+	received := strings.Trim(recorder.Body.String(), "\n")
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -373,6 +459,209 @@ func TestUpdateTags(t *testing.T) {
 	}
 }
 
+// Try changing a member to a job type that only the rules declare
+func TestUpdateNewJobType(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing updating to a job type added to the rules")
+
+	saved := memberRules
+	defer func() { memberRules = saved }()
+	memberRules = []fieldRule{
+		{field: "firstname", label: "first name", required: true},
+		{field: "lastname", label: "last name", required: true},
+		{field: "jobtype", label: "job type", required: true, enum: []string{"Employee", "Contractor", "Intern"}},
+		{field: "role", label: "role", requiredIf: []condition{{"jobtype", "employee"}}, forbiddenIf: []condition{{"jobtype", "contractor"}, {"jobtype", "intern"}}},
+		{field: "duration", label: "duration", requiredIf: []condition{{"jobtype", "contractor"}, {"jobtype", "intern"}}, forbiddenIf: []condition{{"jobtype", "employee"}}},
+	}
+
+	s, router := newTestServer()
+	s.store.Create(context.Background(), Member{ID: "3", FirstName: "Tiro", LastName: "Tullius", JobType: "Employee", Role: "Scribe"})
+	recorder := send(router, "PATCH", "/api/members/3", `{"jobtype":"Intern","duration":"1 summer"}`)
+	assert.Equal(t, 200, recorder.Code, "They should be the same")
+
+	stored, _ := s.store.Get(context.Background(), "3")
+	expected := Member{ID: "3", FirstName: "Tiro", LastName: "Tullius", JobType: "Intern", Duration: "1 summer", Version: 2}
+	stored.Modified = time.Time{}
+	ok := assert.Equal(t, expected, stored, "They should be the same")
+	if ok {
+		fmt.Println("Successfully updated a member to a new job type")
+	}
+}
+
+// Try changing a contractor to an employee with a merge patch that removes the duration
+func TestMergePatchJobType(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing a merge patch that changes the job type")
+
+	recorder := send(Router(), "PATCH", "/api/members/1", `{"jobtype":"Employee","role":"Consul","duration":null}`, "Content-Type", mergePatchType)
+
+	expected := `{"clid":"1","firstname":"Johnny","lastname":"Nolastname","jobtype":"Employee","role":"Consul","tags":["Emperor","Really Cool Guy"],"version":9}`
+	received := strings.Trim(recorder.Body.String(), "\n")
+
+	ok := assert.Equal(t, expected, received, "They should be the same")
+	if ok {
+		fmt.Println("Successfully changed the job type with a merge patch")
+	}
+}
+
+// Try removing a required field with a merge patch
+func TestMergePatchRemoveRole(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing a merge patch that removes an employee's role")
+
+	recorder := send(Router(), "PATCH", "/api/members/1", `{"role":null,"lastname":"Removed"}`, "Content-Type", mergePatchType)
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
+
+	expected := []fieldError{{Field: "role", Rule: "required", Message: "An employee must have a role"}}
+	received := readProblem(recorder).Errors
+
+	// Nothing may be saved when the merged member is invalid
+	member, _ := testServer.store.Get(context.Background(), "1")
+	assert.Equal(t, "Nolastname", member.LastName, "They should be the same")
+
+	ok := assert.Equal(t, expected, received, "They should be the same")
+	if ok {
+		fmt.Println("Failed to remove the role of an employee")
+	}
+}
+
+// Try removing the tags and sending bad merge patches
+func TestMergePatchTags(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing merge patches on tags")
+
+	recorder := send(Router(), "PATCH", "/api/members/1", `{"tags":["Consul"],"firstname":"Gaius"}`, "Content-Type", mergePatchType)
+	assert.Equal(t, 200, recorder.Code, "They should be the same")
+
+	recorder = send(Router(), "PATCH", "/api/members/1", `{"clid":"2"}`, "Content-Type", mergePatchType)
+	assert.Equal(t, codeBadRequest, readProblem(recorder).Code, "They should be the same")
+	recorder = send(Router(), "PATCH", "/api/members/1", `{"tags":"Consul"}`, "Content-Type", mergePatchType)
+	assert.Equal(t, codeBadRequest, readProblem(recorder).Code, "They should be the same")
+	recorder = send(Router(), "PATCH", "/api/members/1", `["tags"]`, "Content-Type", mergePatchType)
+	assert.Equal(t, codeBadRequest, readProblem(recorder).Code, "They should be the same")
+
+	recorder = send(Router(), "PATCH", "/api/members/1", `{"tags":null}`, "Content-Type", mergePatchType)
+	expected := `{"clid":"1","firstname":"Gaius","lastname":"Nolastname","jobtype":"Employee","role":"Consul","tags":[],"version":11}`
+	received := strings.Trim(recorder.Body.String(), "\n")
+
+	ok := assert.Equal(t, expected, received, "They should be the same")
+	if ok {
+		fmt.Println("Successfully removed the tags with a merge patch")
+	}
+}
+
+// Try copying a value and replacing the whole member with a JSON patch
+func TestJSONPatchCopy(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing JSON patches that copy and replace the whole member")
+
+	_, router := newTestServer()
+	send(router, "POST", "/api/members", `{"clid":"5","firstname":"Marcus","lastname":"Tullius","jobtype":"Employee","role":"Consul","tags":["orator"]}`)
+
+	// Changing the copy leaves the original as it was
+	var doc interface{} = map[string]interface{}{"a": map[string]interface{}{"x": "1"}}
+	doc, _ = applyOperation(doc, patchOperation{Op: "copy", From: "/a", Path: "/b"})
+	doc, _ = applyOperation(doc, patchOperation{Op: "add", Path: "/b/y", Value: json.RawMessage(`"2"`)})
+	expectedDoc := map[string]interface{}{"a": map[string]interface{}{"x": "1"}, "b": map[string]interface{}{"x": "1", "y": "2"}}
+	assert.Equal(t, expectedDoc, doc, "They should be the same")
+
+	patch := `[{"op":"copy","from":"/firstname","path":"/lastname"},{"op":"replace","path":"/firstname","value":"Quintus"}]`
+	recorder := send(router, "PATCH", "/api/members/5", patch, "Content-Type", jsonPatchType)
+	var member Member
+	json.NewDecoder(recorder.Body).Decode(&member)
+	assert.Equal(t, []string{"Quintus", "Marcus"}, []string{member.FirstName, member.LastName}, "They should be the same")
+
+	patch = `[{"op":"replace","path":"","value":{"clid":"5","firstname":"Tiro","lastname":"Tullius","jobtype":"Contractor","duration":"40 years"}}]`
+	recorder = send(router, "PATCH", "/api/members/5", patch, "Content-Type", jsonPatchType)
+	expected := `{"clid":"5","firstname":"Tiro","lastname":"Tullius","jobtype":"Contractor","duration":"40 years","tags":[],"version":3}`
+	ok := assert.Equal(t, expected, readText(recorder), "They should be the same")
+	if ok {
+		fmt.Println("Successfully copied values and replaced the whole member")
+	}
+}
+
+// Try adding and removing single tags with a JSON patch
+func TestJSONPatchTags(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing JSON patches on tags")
+
+	recorder := send(Router(), "PATCH", "/api/members/1", `[{"op":"add","path":"/tags/-","value":"Consul"},{"op":"add","path":"/tags/-","value":"Dictator"}]`, "Content-Type", jsonPatchType)
+	assert.Equal(t, 200, recorder.Code, "They should be the same")
+	recorder = send(Router(), "PATCH", "/api/members/1", `[{"op":"test","path":"/tags/0","value":"Consul"},{"op":"remove","path":"/tags/0"}]`, "Content-Type", jsonPatchType)
+	expected := `{"clid":"1","firstname":"Gaius","lastname":"Nolastname","jobtype":"Employee","role":"Consul","tags":["Dictator"],"version":13}`
+	received := strings.Trim(recorder.Body.String(), "\n")
+
+	ok := assert.Equal(t, expected, received, "They should be the same")
+	if ok {
+		fmt.Println("Successfully added and removed tags with a JSON patch")
+	}
+}
+
+// Try JSON patches that cannot be applied. Nothing should change.
+func TestJSONPatchRejected(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing JSON patches that cannot be applied")
+
+	recorder := send(Router(), "PATCH", "/api/members/1", `[{"op":"add","path":"/tags/-","value":"Imperator"},{"op":"test","path":"/lastname","value":"Caesar"}]`, "Content-Type", jsonPatchType)
+	assert.Equal(t, 409, recorder.Code, "They should be the same")
+	recorder = send(Router(), "PATCH", "/api/members/1", `[{"op":"remove","path":"/tags/5"}]`, "Content-Type", jsonPatchType)
+	assert.Equal(t, 409, recorder.Code, "They should be the same")
+	recorder = send(Router(), "PATCH", "/api/members/1", `[{"op":"rename","path":"/tags"}]`, "Content-Type", jsonPatchType)
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
+	recorder = send(Router(), "PATCH", "/api/members/1", `{"op":"remove","path":"/tags"}`, "Content-Type", jsonPatchType)
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
+	recorder = send(Router(), "PATCH", "/api/members/1", `[{"op":"replace","path":"/clid","value":"2"}]`, "Content-Type", jsonPatchType)
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
+	recorder = send(Router(), "PATCH", "/api/members/1", `[{"op":"remove","path":"/role"}]`, "Content-Type", jsonPatchType)
+	assert.Equal(t, codeValidationFailed, readProblem(recorder).Code, "They should be the same")
+
+	// null is a value, unlike a missing one
+	recorder = send(Router(), "PATCH", "/api/members/1", `[{"op":"test","path":"/tags","value":null}]`, "Content-Type", jsonPatchType)
+	assert.Equal(t, "Operation 0 (test /tags): the test failed", readProblem(recorder).Detail, "They should be the same")
+	recorder = send(Router(), "PATCH", "/api/members/1", `[{"op":"replace","path":"/role","value":null}]`, "Content-Type", jsonPatchType)
+	assert.Equal(t, codeValidationFailed, readProblem(recorder).Code, "They should be the same")
+	recorder = send(Router(), "PATCH", "/api/members/1", `[{"op":"replace","path":"/role"}]`, "Content-Type", jsonPatchType)
+	assert.Equal(t, "Operation 0 (replace /role): the operation needs a value", readProblem(recorder).Detail, "They should be the same")
+
+	// A value cannot be moved or copied inside itself
+	recorder = send(Router(), "PATCH", "/api/members/1", `[{"op":"copy","from":"","path":"/x"}]`, "Content-Type", jsonPatchType)
+	assert.Equal(t, `Operation 0 (copy /x): the value at "" cannot be put inside itself`, readProblem(recorder).Detail, "They should be the same")
+	recorder = send(Router(), "PATCH", "/api/members/1", `[{"op":"move","from":"/tags","path":"/tags/0"}]`, "Content-Type", jsonPatchType)
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
+
+	member, _ := testServer.store.Get(context.Background(), "1")
+	ok := assert.Equal(t, []string{"Dictator"}, member.Tags, "They should be the same")
+	if ok {
+		fmt.Println("Successfully rejected JSON patches that could not be applied")
+	}
+}
+
+// Try appending tags from many requests at once. Every tag should be kept.
+func TestJSONPatchConcurrent(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing concurrent JSON patches")
+
+	done := make(chan int)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			recorder := send(Router(), "PATCH", "/api/members/1", fmt.Sprintf(`[{"op":"add","path":"/tags/-","value":"Tag%d"}]`, i), "Content-Type", jsonPatchType)
+			done <- recorder.Code
+		}(i)
+	}
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, 200, <-done, "They should be the same")
+	}
+
+	member, _ := testServer.store.Get(context.Background(), "1")
+	ok := assert.Equal(t, 11, len(member.Tags), "They should be the same")
+	if ok {
+		fmt.Println("Successfully kept every concurrent tag")
+	}
+
+	recorder := send(Router(), "PATCH", "/api/members/1", `[{"op":"replace","path":"/tags","value":["Dictator"]}]`, "Content-Type", jsonPatchType)
+	assert.Equal(t, 200, recorder.Code, "They should be the same")
+}
+
 // Try deleting a member by ID
 func TestDeleteMemberByID(t *testing.T) {
 	fmt.Println("----------------")
@@ -382,8 +671,8 @@ func TestDeleteMemberByID(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	Router().ServeHTTP(recorder, req)
 
-	expected := "Member successfully deleted"
-	received := recorder.Body.String()
+	expected := `{"message":"Member successfully deleted","clid":"1"}`
+	received := strings.Trim(recorder.Body.String(), "\n")
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -391,6 +680,23 @@ func TestDeleteMemberByID(t *testing.T) {
 	}
 }
 
+// Try getting and deleting a member that no longer exists
+func TestMemberNotFound(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing a member ID that does not exist")
+
+	for _, method := range []string{"GET", "PATCH", "DELETE"} {
+		req, _ := http.NewRequest(method, "/api/members/1", bytes.NewBuffer([]byte(`{"firstname":"Ghost"}`)))
+		recorder := httptest.NewRecorder()
+		Router().ServeHTTP(recorder, req)
+
+		assert.Equal(t, 404, recorder.Code, method)
+		assert.Equal(t, "application/problem+json", recorder.Header().Get("Content-Type"), method)
+		assert.Equal(t, codeNotFound, readProblem(recorder).Code, method)
+	}
+	fmt.Println("Successfully reported the missing member")
+}
+
 // Try adding a new member
 func TestAddMember(t *testing.T) {
 	fmt.Println("----------------")
@@ -401,8 +707,8 @@ func TestAddMember(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	Router().ServeHTTP(recorder, req)
 
-	expected := "Created a new member"
-	received := recorder.Body.String()
+	expected := Member{FirstName: "pirate", LastName: "Booty", JobType: "Contractor", Duration: "4 minutes", Tags: []string{"Has scurvy", "Needs Vitamin C"}, Version: 1}
+	received := readCreated(recorder)
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -422,7 +728,8 @@ func TestAddMemberNoFirstName(t *testing.T) {
 	Router().ServeHTTP(recorder, req)
 
 	expected := "The member must have a first name"
-	received := recorder.Body.String()
+	received := readProblem(recorder).Detail
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -439,10 +746,11 @@ func TestAddMemberNoLastName(t *testing.T) {
 
 	req, _ := http.NewRequest("POST", "/api/members", bytes.NewBuffer(testData))
 	recorder := httptest.NewRecorder()
-	createMember(recorder, req)
+	testServer.createMember(recorder, req)
 
 	expected := "The member must have a last name"
-	received := recorder.Body.String()
+	received := readProblem(recorder).Detail
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -450,6 +758,31 @@ func TestAddMemberNoLastName(t *testing.T) {
 	}
 }
 
+// Try adding a member without a first or last name
+func TestAddMemberNoNames(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing creating a member with no first or last name")
+
+	testData := []byte(`{"jobtype": "Employee","role": "President"}`)
+
+	req, _ := http.NewRequest("POST", "/api/members", bytes.NewBuffer(testData))
+	recorder := httptest.NewRecorder()
+	testServer.createMember(recorder, req)
+
+	problem := readProblem(recorder)
+	expected := []fieldError{
+		{Field: "firstname", Rule: "required", Message: "The member must have a first name"},
+		{Field: "lastname", Rule: "required", Message: "The member must have a last name"},
+	}
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
+	assert.Equal(t, "The member must have a first name; The member must have a last name", problem.Detail)
+
+	ok := assert.Equal(t, expected, problem.Errors, "They should be the same")
+	if ok {
+		fmt.Println("Failed to create member with no names, and reported both")
+	}
+}
+
 // Try adding a member with an invalid job type
 func TestAddMemberWrongJobType(t *testing.T) {
 	fmt.Println("----------------")
@@ -459,10 +792,11 @@ func TestAddMemberWrongJobType(t *testing.T) {
 
 	req, _ := http.NewRequest("POST", "/api/members", bytes.NewBuffer(testData))
 	recorder := httptest.NewRecorder()
-	createMember(recorder, req)
+	testServer.createMember(recorder, req)
 
 	expected := "The job type provided is not valid. Please provide either 'Employee' or 'Contractor'"
-	received := recorder.Body.String()
+	received := readProblem(recorder).Detail
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -479,10 +813,11 @@ func TestAddMemberContractorRole(t *testing.T) {
 
 	req, _ := http.NewRequest("POST", "/api/members", bytes.NewBuffer(testData))
 	recorder := httptest.NewRecorder()
-	createMember(recorder, req)
+	testServer.createMember(recorder, req)
 
-	expected := "A contractor cannot have a role"
-	received := recorder.Body.String()
+	expected := "A contractor cannot have a role; A contractor must have a duration"
+	received := readProblem(recorder).Detail
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -499,10 +834,11 @@ func TestAddContractorNoDuration(t *testing.T) {
 
 	req, _ := http.NewRequest("POST", "/api/members", bytes.NewBuffer(testData))
 	recorder := httptest.NewRecorder()
-	createMember(recorder, req)
+	testServer.createMember(recorder, req)
 
 	expected := "A contractor must have a duration"
-	received := recorder.Body.String()
+	received := readProblem(recorder).Detail
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -519,10 +855,14 @@ func TestAddBothRoleDuration(t *testing.T) {
 
 	req, _ := http.NewRequest("POST", "/api/members", bytes.NewBuffer(testData))
 	recorder := httptest.NewRecorder()
-	createMember(recorder, req)
+	testServer.createMember(recorder, req)
 
-	expected := "A member cannot have both a duration and a role"
-	received := recorder.Body.String()
+	expected := []fieldError{
+		{Field: "role", Rule: "exclusive", Message: "A member cannot have both a role and a duration"},
+		{Field: "role", Rule: "forbidden", Message: "A contractor cannot have a role"},
+	}
+	received := readProblem(recorder).Errors
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -539,10 +879,11 @@ func TestAddEmployeeNoRole(t *testing.T) {
 
 	req, _ := http.NewRequest("POST", "/api/members", bytes.NewBuffer(testData))
 	recorder := httptest.NewRecorder()
-	createMember(recorder, req)
+	testServer.createMember(recorder, req)
 
 	expected := "An employee must have a role"
-	received := recorder.Body.String()
+	received := readProblem(recorder).Detail
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -559,10 +900,14 @@ func TestAddEmployeeDuration(t *testing.T) {
 
 	req, _ := http.NewRequest("POST", "/api/members", bytes.NewBuffer(testData))
 	recorder := httptest.NewRecorder()
-	createMember(recorder, req)
+	testServer.createMember(recorder, req)
 
-	expected := "An employee cannot have a duration"
-	received := recorder.Body.String()
+	expected := []fieldError{
+		{Field: "role", Rule: "required", Message: "An employee must have a role"},
+		{Field: "duration", Rule: "forbidden", Message: "An employee cannot have a duration"},
+	}
+	received := readProblem(recorder).Errors
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -579,10 +924,10 @@ func TestAddValidContractor(t *testing.T) {
 
 	req, _ := http.NewRequest("POST", "/api/members", bytes.NewBuffer(testData))
 	recorder := httptest.NewRecorder()
-	createMember(recorder, req)
+	testServer.createMember(recorder, req)
 
-	expected := "Created a new member"
-	received := recorder.Body.String()
+	expected := Member{FirstName: "Baberaham", LastName: "Lincoln", JobType: "Contractor", Duration: "1 year", Tags: []string{"Maybe a president"}, Version: 1}
+	received := readCreated(recorder)
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -599,10 +944,10 @@ func TestAddValidEmployee(t *testing.T) {
 
 	req, _ := http.NewRequest("POST", "/api/members", bytes.NewBuffer(testData))
 	recorder := httptest.NewRecorder()
-	createMember(recorder, req)
+	testServer.createMember(recorder, req)
 
-	expected := "Created a new member"
-	received := recorder.Body.String()
+	expected := Member{FirstName: "Julius", LastName: "Caesar", JobType: "Employee", Role: "Imperator", Tags: []string{"He wasn't actually an emperor"}, Version: 1}
+	received := readCreated(recorder)
 
 	ok := assert.Equal(t, expected, received, "They should be the same")
 	if ok {
@@ -610,29 +955,800 @@ func TestAddValidEmployee(t *testing.T) {
 	}
 }
 
+// Try adding a member with an ID that is already in use
+func TestAddMemberDuplicateID(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing creating a member with an ID already in use")
+
+	testData := []byte(`{"clid": "42", "firstname": "Marcus", "lastname": "Brutus","jobtype": "Employee", "role": "Senator"}`)
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", "/api/members", bytes.NewBuffer(testData))
+		recorder := httptest.NewRecorder()
+		Router().ServeHTTP(recorder, req)
+
+		if i == 1 {
+			var received createdMember
+			json.NewDecoder(recorder.Body).Decode(&received)
+			assert.Equal(t, 201, recorder.Code, "They should be the same")
+			assert.NotEqual(t, "42", received.ID, "A new ID should have been generated")
+			assert.Equal(t, "Marcus", received.FirstName, "They should be the same")
+			assert.Equal(t, "/api/members/"+received.ID, recorder.Header().Get("Location"), "They should be the same")
+			assert.Equal(t, "The provided ID 42 was already in use, so the member was created with ID "+received.ID, received.Warning, "They should be the same")
+			assert.True(t, strings.HasPrefix(recorder.Header().Get("Warning"), `299 - "`), recorder.Header().Get("Warning"))
+		}
+	}
+
+	// The store itself must also refuse a duplicate ID
+	_, err := testServer.store.Create(context.Background(), Member{ID: "42"})
+	ok := assert.Equal(t, errDuplicateID, err, "They should be the same")
+	if ok {
+		fmt.Println("Successfully kept member IDs unique")
+	}
+}
+
+// Try creating a member with an ID already in use in strict mode. It should be refused, not renamed.
+func TestAddMemberDuplicateIDStrict(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing creating a member with an ID already in use in strict mode")
+
+	testData := []byte(`{"clid": "42", "firstname": "Decimus", "lastname": "Brutus","jobtype": "Employee", "role": "Senator"}`)
+	req, _ := http.NewRequest("POST", "/api/members?strict=true", bytes.NewBuffer(testData))
+	recorder := httptest.NewRecorder()
+	Router().ServeHTTP(recorder, req)
+	assert.Equal(t, 409, recorder.Code, "They should be the same")
+	assert.Equal(t, codeConflict, readProblem(recorder).Code, "They should be the same")
+
+	member, _ := testServer.store.Get(context.Background(), "42")
+	ok := assert.Equal(t, "Marcus", member.FirstName, "They should be the same")
+	if ok {
+		fmt.Println("Successfully refused a duplicate ID in strict mode")
+	}
+}
+
+// Send a PUT for a member with the provided headers
+func put(path string, body string, header string, value string) *httptest.ResponseRecorder {
+	return send(Router(), "PUT", path, body, header, value)
+}
+
+// Try replacing a member, and creating one only when upserting
+func TestReplaceMember(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing replacing a member with PUT")
+
+	brutus := `{"firstname": "Decimus", "lastname": "Brutus", "jobtype": "Contractor", "duration": "3 years"}`
+	recorder := put("/api/members/42", brutus, "", "")
+	assert.Equal(t, 200, recorder.Code, "They should be the same")
+	expected := `{"clid":"42","firstname":"Decimus","lastname":"Brutus","jobtype":"Contractor","duration":"3 years","tags":[],"version":2}`
+	assert.Equal(t, expected, strings.Trim(recorder.Body.String(), "\n"), "They should be the same")
+
+	recorder = put("/api/members/43", brutus, "", "")
+	assert.Equal(t, 404, recorder.Code, "They should be the same")
+	recorder = put("/api/members/43", `{"clid": "44", "firstname": "Decimus", "lastname": "Brutus"}`, "", "")
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
+	recorder = put("/api/members/43?upsert=true", `{"firstname": "Decimus", "lastname": "Brutus"}`, "", "")
+	assert.Equal(t, codeValidationFailed, readProblem(recorder).Code, "They should be the same")
+
+	// Upserting the same record twice creates it once and then changes nothing
+	recorder = put("/api/members/43?upsert=true", brutus, "", "")
+	assert.Equal(t, 201, recorder.Code, "They should be the same")
+	assert.Equal(t, "/api/members/43", recorder.Header().Get("Location"), "They should be the same")
+	recorder = put("/api/members/43?upsert=true", brutus, "", "")
+	assert.Equal(t, 200, recorder.Code, "They should be the same")
+	assert.Empty(t, recorder.Header().Get("Location"), "A replaced member should have no Location")
+
+	recorder = put("/api/members/44", brutus, "If-None-Match", "*")
+	assert.Equal(t, 201, recorder.Code, "They should be the same")
+	recorder = put("/api/members/44", brutus, "If-None-Match", "*")
+	ok := assert.Equal(t, codePreconditionFailed, readProblem(recorder).Code, "They should be the same")
+	if ok {
+		fmt.Println("Successfully replaced and upserted members")
+	}
+}
+
+// Try writing with a stale ETag, then with the current one
+func TestIfMatch(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing If-Match on updates and deletes")
+
+	req, _ := http.NewRequest("GET", "/api/members/42", nil)
+	recorder := httptest.NewRecorder()
+	Router().ServeHTTP(recorder, req)
+	assert.Equal(t, `"2"`, recorder.Header().Get("ETag"), "They should be the same")
+
+	patch := func(etag string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PATCH", "/api/members/42", bytes.NewBuffer([]byte(`{"lastname":"Albinus"}`)))
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+		req.Header.Set("If-Match", etag)
+		recorder := httptest.NewRecorder()
+		Router().ServeHTTP(recorder, req)
+		return recorder
+	}
+	recorder = patch(`"1"`)
+	assert.Equal(t, codePreconditionFailed, readProblem(recorder).Code, "They should be the same")
+	recorder = patch(`W/"2"`)
+	assert.Equal(t, 412, recorder.Code, "They should be the same")
+	recorder = patch(`"1", "2"`)
+	assert.Equal(t, 200, recorder.Code, "They should be the same")
+	assert.Equal(t, `"3"`, recorder.Header().Get("ETag"), "They should be the same")
+
+	// A patch that changes nothing keeps the version, so other clients' ETags still hold
+	for _, body := range []string{`{}`, `{"lastname":"Albinus"}`} {
+		req, _ := http.NewRequest("PATCH", "/api/members/42", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+		recorder = httptest.NewRecorder()
+		Router().ServeHTTP(recorder, req)
+		assert.Equal(t, `"3"`, recorder.Header().Get("ETag"), body)
+	}
+
+	brutus := `{"firstname": "Decimus", "lastname": "Brutus", "jobtype": "Contractor", "duration": "3 years"}`
+	recorder = put("/api/members/42", brutus, "If-Match", `"2"`)
+	assert.Equal(t, 412, recorder.Code, "They should be the same")
+	recorder = put("/api/members/45?upsert=true", brutus, "If-Match", "*")
+	assert.Equal(t, 412, recorder.Code, "They should be the same")
+
+	remove := func(etag string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("DELETE", "/api/members/42", nil)
+		req.Header.Set("If-Match", etag)
+		recorder := httptest.NewRecorder()
+		Router().ServeHTTP(recorder, req)
+		return recorder
+	}
+	recorder = remove(`"2"`)
+	assert.Equal(t, 412, recorder.Code, "They should be the same")
+	recorder = remove(`"3"`)
+	ok := assert.Equal(t, 200, recorder.Code, "They should be the same")
+	if ok {
+		fmt.Println("Successfully rejected stale writes")
+	}
+}
+
+// Send a GET with a conditional header
+func getIf(path string, header string, value string) *httptest.ResponseRecorder {
+	return send(Router(), "GET", path, "", header, value)
+}
+
+// Try asking again for a member and the list only if they changed
+func TestConditionalGet(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing conditional GETs")
+
+	recorder := getIf("/api/members/43", "Accept", "application/json")
+	tag, modified := recorder.Header().Get("ETag"), recorder.Header().Get("Last-Modified")
+	assert.NotEmpty(t, modified, "There should be a Last-Modified time")
+
+	recorder = getIf("/api/members/43", "If-None-Match", tag)
+	assert.Equal(t, 304, recorder.Code, "They should be the same")
+	assert.Equal(t, "", recorder.Body.String(), "They should be the same")
+	recorder = getIf("/api/members/43", "If-Modified-Since", modified)
+	assert.Equal(t, 304, recorder.Code, "They should be the same")
+	recorder = getIf("/api/members/43", "If-Modified-Since", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+	assert.Equal(t, 200, recorder.Code, "They should be the same")
+
+	recorder = getIf("/api/members", "Accept", "application/json")
+	listTag := recorder.Header().Get("ETag")
+	recorder = getIf("/api/members", "If-None-Match", listTag)
+	assert.Equal(t, 304, recorder.Code, "They should be the same")
+
+	// The list has no change time, since deleting a member would not move it
+	assert.Equal(t, "", recorder.Header().Get("Last-Modified"), "They should be the same")
+	recorder = getIf("/api/members", "If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	assert.Equal(t, 200, recorder.Code, "They should be the same")
+
+	// Any change to a member in the list changes the list's ETag
+	req, _ := http.NewRequest("PATCH", "/api/members/43", bytes.NewBuffer([]byte(`{"lastname":"Albinus"}`)))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	Router().ServeHTTP(httptest.NewRecorder(), req)
+	recorder = getIf("/api/members", "If-None-Match", listTag)
+	ok := assert.Equal(t, 200, recorder.Code, "They should be the same")
+	if ok {
+		fmt.Println("Successfully answered unchanged data with 304")
+	}
+}
+
+// Try filtering the member list with query parameters
+func TestFilterMembers(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing filtering members")
+
+	recorder := getIf("/api/members?jobtype=CONTRACTOR&duration=3+years", "Accept", "application/json")
+	members := readList(recorder)
+	ids := []string{}
+	for _, m := range members {
+		ids = append(ids, m.ID)
+	}
+	assert.Equal(t, []string{"43", "44"}, ids, "They should be the same")
+
+	recorder = getIf("/api/members?tag=Emperor&tag=Dictator&tag_match=any", "Accept", "application/json")
+	assert.Equal(t, `{"items":[],"count":0}`+"\n", recorder.Body.String(), "They should be the same")
+	recorder = getIf("/api/members?tag=Emperor&tag_match=some", "Accept", "application/json")
+	ok := assert.Equal(t, codeBadRequest, readProblem(recorder).Code, "They should be the same")
+	if ok {
+		fmt.Println("Successfully filtered members")
+	}
+}
+
+// Try reading the member list a page at a time by following the Link headers
+func TestPaginateMembers(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing paging through members")
+
+	recorder := getIf("/api/members", "Accept", "application/json")
+	all := readList(recorder)
+
+	var paged []Member
+	next := "/api/members?limit=2"
+	for pages := 0; next != ""; pages++ {
+		recorder = getIf(next, "Accept", "application/json")
+		page := readList(recorder)
+		assert.LessOrEqual(t, len(page), 2, "A page should not be larger than the limit")
+		paged = append(paged, page...)
+
+		next = ""
+		if link := recorder.Header().Get("Link"); link != "" {
+			next = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+		}
+		if pages > len(all) {
+			t.Fatal("The pages never ended")
+		}
+	}
+	assert.Equal(t, all, paged, "They should be the same")
+
+	recorder = getIf("/api/members?limit=0", "Accept", "application/json")
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
+	recorder = getIf("/api/members?cursor=not-a-cursor", "Accept", "application/json")
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
+
+	// A full page gets a new ETag once a member after it gives it a next page
+	s, router := newTestServer()
+	s.store.Create(context.Background(), Member{ID: "1", FirstName: "Ann", LastName: "Smith", JobType: "Contractor", Duration: "1 year"})
+	tag := send(router, "GET", "/api/members?limit=1", "").Header().Get("ETag")
+	s.store.Create(context.Background(), Member{ID: "2", FirstName: "Bob", LastName: "Jones", JobType: "Contractor", Duration: "1 year"})
+	recorder = send(router, "GET", "/api/members?limit=1", "", "If-None-Match", tag)
+	assert.Equal(t, 200, recorder.Code, "They should be the same")
+	ok := assert.NotEmpty(t, recorder.Header().Get("Link"), "The page should link to the next one")
+	if ok {
+		fmt.Println("Successfully paged through members")
+	}
+}
+
+// Try sorting the list and asking for only some fields
+func TestSortMembers(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing sorting members and choosing fields")
+
+	recorder := getIf("/api/members?sort=-lastname,firstname", "Accept", "application/json")
+	assert.Equal(t, 200, recorder.Code, "They should be the same")
+	sorted := readList(recorder)
+	for i := 1; i < len(sorted); i++ {
+		assert.GreaterOrEqual(t, sorted[i-1].LastName, sorted[i].LastName, "The list should be sorted by lastname, descending")
+	}
+
+	// Paging through a sorted list gives the same list
+	var paged []Member
+	next := "/api/members?sort=-lastname,firstname&limit=1"
+	for pages := 0; next != ""; pages++ {
+		recorder = getIf(next, "Accept", "application/json")
+		page := readList(recorder)
+		paged = append(paged, page...)
+
+		next = ""
+		if link := recorder.Header().Get("Link"); link != "" {
+			next = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+		}
+		if pages > len(sorted) {
+			t.Fatal("The pages never ended")
+		}
+	}
+	assert.Equal(t, sorted, paged, "They should be the same")
+
+	// A cursor only works for the sort order it was made for
+	recorder = getIf("/api/members?sort=lastname&limit=1", "Accept", "application/json")
+	link := strings.TrimSuffix(strings.TrimPrefix(recorder.Header().Get("Link"), "<"), `>; rel="next"`)
+	recorder = getIf(strings.Replace(link, "sort=lastname", "sort=firstname", 1), "Accept", "application/json")
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
+
+	recorder = getIf("/api/members?sort=lastname&fields=clid,lastname", "Accept", "application/json")
+	var projected struct {
+		Items []map[string]interface{} `json:"items"`
+	}
+	json.NewDecoder(recorder.Body).Decode(&projected)
+	assert.Equal(t, len(sorted), len(projected.Items), "They should be the same")
+	for _, m := range projected.Items {
+		assert.Len(t, m, 2, "Only clid and lastname should be sent")
+	}
+
+	recorder = getIf("/api/members/"+sorted[0].ID+"?fields=firstname,tags", "Accept", "application/json")
+	assert.Equal(t, 200, recorder.Code, "They should be the same")
+	assert.Equal(t, `"`+strconv.FormatInt(sorted[0].Version, 10)+`"`, recorder.Header().Get("ETag"), "They should be the same")
+	var member map[string]interface{}
+	json.NewDecoder(recorder.Body).Decode(&member)
+	assert.Equal(t, map[string]interface{}{"firstname": sorted[0].FirstName, "tags": toInterfaces(sorted[0].Tags)}, member, "They should be the same")
+
+	for _, bad := range []string{"/api/members?sort=tags", "/api/members?sort=clid,-clid", "/api/members?fields=password", "/api/members/" + sorted[0].ID + "?fields=nope"} {
+		recorder = getIf(bad, "Accept", "application/json")
+		assert.Equal(t, 400, recorder.Code, bad)
+	}
+	ok := assert.Equal(t, codeBadRequest, readProblem(recorder).Code, "They should be the same")
+	if ok {
+		fmt.Println("Successfully sorted members and chose fields")
+	}
+}
+
+// The tags of a member as they come out of a JSON object
+func toInterfaces(values []string) []interface{} {
+	result := []interface{}{}
+	for _, v := range values {
+		result = append(result, v)
+	}
+	return result
+}
+
+// Try searching members by name, role and tags
+func TestSearchMembers(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing searching members")
+
+	ctx := context.Background()
+	testServer.store.Create(ctx, Member{ID: "s1", FirstName: "Zenobia", LastName: "Septimia", JobType: "Employee", Role: "Queen"})
+	testServer.store.Create(ctx, Member{ID: "s2", FirstName: "Zeno", LastName: "Isaurus", JobType: "Contractor", Tags: []string{"Zenobia fan"}})
+	defer testServer.store.Delete(ctx, "s1", 0)
+	defer testServer.store.Delete(ctx, "s2", 0)
+
+	search := func(url string) []string {
+		recorder := getIf(url, "Accept", "application/json")
+		assert.Equal(t, 200, recorder.Code, url)
+		members := readList(recorder)
+		ids := []string{}
+		for _, m := range members {
+			ids = append(ids, m.ID)
+		}
+		return ids
+	}
+	// A whole first name counts more than a tag, and a whole word more than its start
+	assert.Equal(t, []string{"s1", "s2"}, search("/api/members/search?q=zenobia"), "They should be the same")
+	assert.Equal(t, []string{"s2", "s1"}, search("/api/members/search?q=ZENO"), "They should be the same")
+	// Equally relevant members come by clid
+	assert.Equal(t, []string{"s1", "s2"}, search("/api/members/search?q=zen"), "They should be the same")
+	assert.Equal(t, []string{"s1"}, search("/api/members/search?q=zen&limit=1"), "They should be the same")
+	assert.Equal(t, []string{"s1"}, search("/api/members/search?q=zen+queen"), "They should be the same")
+	assert.Equal(t, []string{}, search("/api/members/search?q=zenith"), "They should be the same")
+	// One-letter words are left out
+	assert.Equal(t, []string{"s1"}, search("/api/members/search?q=Q+zen+queen"), "They should be the same")
+
+	for _, bad := range []string{"/api/members/search", "/api/members/search?q=+-+", "/api/members/search?q=zen&limit=101", "/api/members/search?q=a", "/api/members/search?q=a+b"} {
+		recorder := getIf(bad, "Accept", "application/json")
+		assert.Equal(t, 400, recorder.Code, bad)
+	}
+	recorder := getIf("/api/members/search?q=aa+bb+cc+dd+ee+ff+gg+hh+ii+jj+kk", "Accept", "application/json")
+	assert.Equal(t, codeBadRequest, readProblem(recorder).Code, "They should be the same")
+
+	// A search matching more members than are ranked says so
+	s, router := newTestServer()
+	var many []Member
+	for i := 0; i <= maxSearchCandidates; i++ {
+		many = append(many, Member{ID: fmt.Sprintf("%04d", i), FirstName: "Zeno", LastName: "Isaurus", JobType: "Contractor", Duration: "17 years"})
+	}
+	s.store.CreateMany(ctx, many, false)
+	var list memberList
+	json.NewDecoder(send(router, "GET", "/api/members/search?q=zeno", "").Body).Decode(&list)
+	ok := assert.True(t, list.Truncated, "The search should be truncated")
+	if ok {
+		fmt.Println("Successfully searched members")
+	}
+}
+
+// Try creating a member with the clid the search route takes, or one its URL could not hold
+func TestReservedID(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing refusing a reserved clid")
+
+	for _, clid := range []string{"a/b", "   "} {
+		recorder := send(Router(), "POST", "/api/members", `{"clid": "`+clid+`", "firstname": "Zeno", "lastname": "Isaurus", "jobtype": "Contractor", "duration": "17 years"}`)
+		assert.Equal(t, codeValidationFailed, readProblem(recorder).Code, clid)
+	}
+
+	member := `{"clid": "search", "firstname": "Zeno", "lastname": "Isaurus", "jobtype": "Contractor", "duration": "17 years"}`
+	recorder := send(Router(), "POST", "/api/members", member)
+	assert.Equal(t, codeValidationFailed, readProblem(recorder).Code, "They should be the same")
+
+	recorder = put("/api/members/search?upsert=true", member, "", "")
+	assert.Equal(t, codeValidationFailed, readProblem(recorder).Code, "They should be the same")
+
+	response := readBatch(send(Router(), "POST", "/api/members:batch", "["+member+"]"))
+	assert.Equal(t, 0, response.Created, "They should be the same")
+	ok := assert.Equal(t, codeValidationFailed, response.Items[0].Code, "They should be the same")
+	if ok {
+		fmt.Println("Successfully refused a reserved clid")
+	}
+}
+
+// Try the list envelope, and asking for the legacy text responses with the Accept header
+func TestLegacyText(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing the list envelope and legacy text responses")
+
+	recorder := getIf("/api/members?limit=1", "Accept", "application/json")
+	var list memberList
+	json.NewDecoder(recorder.Body).Decode(&list)
+	assert.Equal(t, 1, list.Count, "They should be the same")
+	assert.Equal(t, "<"+list.Next+`>; rel="next"`, recorder.Header().Get("Link"), "They should be the same")
+
+	// A separate empty server, so the collection really has no members
+	_, router := newTestServer()
+	member := `{"clid":"7","firstname":"Gaius","lastname":"Octavius","jobtype":"Employee","role":"Augustus"}`
+
+	assert.Equal(t, "The collection currently has no members.", readText(send(router, "GET", "/api/members", "", "Accept", "text/plain")), "They should be the same")
+	assert.Equal(t, "[]", readText(send(router, "GET", "/api/members?role=Augustus", "", "Accept", "text/plain")), "They should be the same")
+	recorder = send(router, "POST", "/api/members", member, "Accept", "text/plain")
+	assert.Equal(t, "Created a new member", readText(recorder), "They should be the same")
+	assert.Equal(t, "text/plain; charset=utf-8", recorder.Header().Get("Content-Type"), "They should be the same")
+	received := readText(send(router, "POST", "/api/members", member, "Accept", "text/plain, application/json;q=0.9"))
+	assert.True(t, strings.HasPrefix(received, "The provided ID was not unique, so a unique one with ID "), received)
+	assert.True(t, strings.HasPrefix(readText(send(router, "GET", "/api/members", "", "Accept", "text/plain")), `[{"clid":`), "The legacy list should be a bare array")
+	assert.Contains(t, readText(send(router, "GET", "/api/members", "")), `"role":"Augustus","tags":[]`, "A member without tags should have an empty list")
+	assert.Equal(t, "Member successfully deleted", readText(send(router, "DELETE", "/api/members/7", "", "Accept", "text/plain")), "They should be the same")
+	assert.Equal(t, "Successfully deleted all members", readText(send(router, "DELETE", "/api/members", "", "Accept", "text/plain")), "They should be the same")
+
+	// The JSON and text lists are told apart by caches and have different ETags
+	recorder = send(router, "GET", "/api/members", "", "Accept", "text/plain")
+	assert.Equal(t, "Accept", recorder.Header().Get("Vary"), "They should be the same")
+	textTag := recorder.Header().Get("ETag")
+	recorder = send(router, "GET", "/api/members", "", "Accept", "application/json")
+	assert.NotEqual(t, textTag, recorder.Header().Get("ETag"), "They should be different")
+	recorder = send(router, "GET", "/api/members", "", "Accept", "application/json", "If-None-Match", textTag)
+	assert.Equal(t, 200, recorder.Code, "The text ETag should not match the JSON list")
+
+	// JSON wins a tie, and is the default for */*, text/* and a browser's Accept header
+	browser := "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+	for _, accept := range []string{"", "*/*", "application/json, text/plain", "text/*;q=0.5, application/*", "text/plain;q=0", "text/html", "text/*", browser} {
+		assert.Equal(t, `{"items":[],"count":0}`, readText(send(router, "GET", "/api/members", "", "Accept", accept)), accept)
+	}
+	ok := assert.Equal(t, `{"message":"Successfully deleted all members"}`, readText(send(router, "DELETE", "/api/members", "", "Accept", "application/json")), "They should be the same")
+	if ok {
+		fmt.Println("Successfully sent the list envelope and legacy text")
+	}
+}
+
+// Try sending bodies that are not valid JSON members
+func TestStrictDecoding(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing reading request bodies strictly")
+
+	s, router := newTestServer()
+	member := `{"clid":"7","firstname":"Gaius","lastname":"Octavius","jobtype":"Employee","role":"Augustus","rich":"very","legions":28}`
+
+	// Malformed JSON is a bad request, not a missing first name
+	bodies := map[string]string{
+		"":                    "The request body is empty. Please send the member as a JSON object",
+		`{"firstname": "Ga`:   "The request body is not valid JSON: unexpected end of JSON input (at byte 17)",
+		`{"firstname": 7}`:    "The field firstname must be a string, but the request has a JSON number",
+		`{"tags": "go"}`:      "The field tags must be an array of strings, but the request has a JSON string",
+		`["Gaius"]`:           "The request body must be a JSON object",
+		`{"firstname":"A"} x`: "The request body is not valid JSON: invalid character 'x' after top-level value (at byte 19)",
+	}
+	for body, detail := range bodies {
+		for method, path := range map[string]string{"POST": "/api/members", "PUT": "/api/members/7"} {
+			recorder := send(router, method, path, body, "Content-Type", "application/json")
+			problem := readProblem(recorder)
+			assert.Equal(t, 400, recorder.Code, body)
+			assert.Equal(t, codeBadRequest, problem.Code, body)
+			assert.Equal(t, detail, problem.Detail, body)
+		}
+	}
+	recorder := send(router, "POST", "/api/members", `{"firstname":"`+strings.Repeat("a", maxBodyBytes)+`"}`, "Content-Type", "application/json")
+	assert.Equal(t, 413, recorder.Code, "They should be the same")
+	assert.Equal(t, codeTooLarge, readProblem(recorder).Code, "They should be the same")
+
+	// By default unknown fields are dropped
+	recorder = send(router, "POST", "/api/members", member, "Content-Type", "application/json")
+	assert.Equal(t, 201, recorder.Code, "They should be the same")
+
+	// Rejecting them lists every one, and saves nothing
+	s.rejectUnknownFields = true
+	for _, r := range []struct{ method, path, contentType string }{
+		{"POST", "/api/members", "application/json"},
+		{"PUT", "/api/members/7", "application/json"},
+		{"PATCH", "/api/members/7", "application/json"},
+		{"PATCH", "/api/members/7", mergePatchType},
+	} {
+		recorder = send(router, r.method, r.path, member, "Content-Type", r.contentType)
+		problem := readProblem(recorder)
+		assert.Equal(t, 400, recorder.Code, r.method+" "+r.contentType)
+		assert.Equal(t, "The request has fields a member does not have: legions, rich", problem.Detail, r.method)
+		assert.Equal(t, []fieldError{
+			{Field: "legions", Rule: "unknown", Message: `A member has no field "legions"`},
+			{Field: "rich", Rule: "unknown", Message: `A member has no field "rich"`},
+		}, problem.Errors, r.method)
+	}
+	// A JSON patch is judged by its paths, and by its value when it replaces the whole member
+	for _, path := range []string{"/api/members/7", "/api/members?jobtype=employee"} {
+		recorder = send(router, "PATCH", path, `[{"op":"add","path":"/rich","value":true},{"op":"add","path":"/tags/-","value":"x"},{"op":"remove","path":"/legions/0"}]`, "Content-Type", jsonPatchType)
+		problem := readProblem(recorder)
+		assert.Equal(t, 400, recorder.Code, path)
+		assert.Equal(t, "The request has fields a member does not have: legions, rich", problem.Detail, path)
+	}
+	recorder = send(router, "PATCH", "/api/members/7", `[{"op":"replace","path":"","value":{"clid":"7","firstname":"Gaius","rich":"very"}}]`, "Content-Type", jsonPatchType)
+	assert.Equal(t, "The request has fields a member does not have: rich", readProblem(recorder).Detail, "They should be the same")
+	stored, _ := s.store.Get(context.Background(), "7")
+	assert.Equal(t, int64(1), stored.Version, "Nothing should have been saved")
+
+	recorder = send(router, "PATCH", "/api/members/7", `{"lastname":"Augustus","version":1}`, "Content-Type", "application/json")
+	ok := assert.Equal(t, 200, recorder.Code, "They should be the same")
+	if ok {
+		fmt.Println("Successfully read request bodies strictly")
+	}
+}
+
+// Try creating many members at once
+func TestBatchCreate(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing creating a batch of members")
+
+	s, router := newTestServer()
+	statuses := func(results []batchResult) []int {
+		codes := []int{}
+		for _, result := range results {
+			codes = append(codes, result.Status)
+		}
+		return codes
+	}
+	ctx := context.Background()
+
+	// Every member gets a result in batch order, and only the valid ones are saved
+	batch := `[
+		{"clid":"b1","firstname":"Ann","lastname":"Smith","jobtype":"Employee","role":"Team Lead"},
+		{"firstname":"Bob","lastname":"Jones","jobtype":"Contractor","duration":"6 months"},
+		{"firstname":"Carol","jobtype":"Employee"},
+		{"firstname":7},
+		{"clid":"b1","firstname":"Dan","lastname":"Lee","jobtype":"Employee","role":"Engineer"}
+	]`
+	recorder := send(router, "POST", "/api/members:batch", batch, "Content-Type", "application/json")
+	response := readBatch(recorder)
+	assert.Equal(t, 200, recorder.Code, "They should be the same")
+	assert.Equal(t, []int{201, 201, 400, 400, 409}, statuses(response.Items), "They should be the same")
+	assert.Equal(t, []int{5, 2, 3}, []int{response.Count, response.Created, response.Failed}, "They should be the same")
+	assert.Equal(t, "b1", response.Items[0].ID, "They should be the same")
+	assert.NotEmpty(t, response.Items[1].ID, "A generated ID should be sent back")
+	assert.Equal(t, codeValidationFailed, response.Items[2].Code, "They should be the same")
+	assert.Equal(t, "lastname", response.Items[2].Errors[0].Field, "They should be the same")
+	assert.Equal(t, "The field firstname must be a string, but the request has a JSON number", response.Items[3].Detail, "They should be the same")
+	assert.Equal(t, codeConflict, response.Items[4].Code, "They should be the same")
+	stored, _ := s.store.Get(ctx, "b1")
+	assert.Equal(t, "Ann", stored.FirstName, "They should be the same")
+
+	// One member per line, skipping blank lines
+	ndjson := "{\"clid\":\"b2\",\"firstname\":\"Eve\",\"lastname\":\"Park\",\"jobtype\":\"Employee\",\"role\":\"Engineer\"}\n\n" +
+		"{\"clid\":\"b3\",\"firstname\":\"Fay\",\"lastname\":\"Wu\",\"jobtype\":\"Contractor\",\"duration\":\"1 year\"}\n"
+	recorder = send(router, "POST", "/api/members:batch", ndjson, "Content-Type", "application/x-ndjson")
+	response = readBatch(recorder)
+	assert.Equal(t, []int{201, 201}, statuses(response.Items), "They should be the same")
+
+	// All or nothing: one failure means no member is saved, and the valid ones say why
+	atomic := `[
+		{"clid":"b4","firstname":"Gus","lastname":"Hale","jobtype":"Employee","role":"Engineer"},
+		{"clid":"b2","firstname":"Hal","lastname":"Ito","jobtype":"Employee","role":"Engineer"}
+	]`
+	recorder = send(router, "POST", "/api/members:batch?atomic=true", atomic, "Content-Type", "application/json")
+	problem := readProblem(recorder)
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
+	assert.Equal(t, []int{424, 409}, statuses(problem.Items), "They should be the same")
+	assert.Equal(t, codeFailedDependency, problem.Items[0].Code, "They should be the same")
+	_, err := s.store.Get(ctx, "b4")
+	assert.Equal(t, errMemberNotFound, err, "Nothing should have been saved")
+
+	recorder = send(router, "POST", "/api/members:batch?atomic=true", `[{"clid":"b4","firstname":"Gus","lastname":"Hale","jobtype":"Employee","role":"Engineer"},{}]`, "Content-Type", "application/json")
+	assert.Equal(t, []int{424, 400}, statuses(readProblem(recorder).Items), "They should be the same")
+	recorder = send(router, "POST", "/api/members:batch?atomic=true", `[{"clid":"b4","firstname":"Gus","lastname":"Hale","jobtype":"Employee","role":"Engineer"}]`, "Content-Type", "application/json")
+	assert.Equal(t, []int{201}, statuses(readBatch(recorder).Items), "They should be the same")
+
+	// The batch itself can be refused
+	recorder = send(router, "POST", "/api/members:batch", `{"firstname":"Ann"}`, "Content-Type", "application/json")
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
+	recorder = send(router, "POST", "/api/members:batch", `[]`, "Content-Type", "application/json")
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
+	recorder = send(router, "POST", "/api/members:batch", "["+strings.Repeat("{},", maxBatchMembers)+"{}]", "Content-Type", "application/json")
+	ok := assert.Equal(t, codeTooLarge, readProblem(recorder).Code, "They should be the same")
+	if ok {
+		fmt.Println("Successfully created a batch of members")
+	}
+}
+
+// Try updating every member that passes a filter
+func TestBulkUpdate(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing bulk updates")
+
+	s, router := newTestServer()
+	ctx := context.Background()
+	s.store.CreateMany(ctx, []Member{
+		{ID: "1", FirstName: "Ann", LastName: "Smith", JobType: "Contractor", Duration: "6 months"},
+		{ID: "2", FirstName: "Bob", LastName: "Jones", JobType: "Contractor", Duration: "1 year", Tags: []string{"remote"}},
+		{ID: "3", FirstName: "Carol", LastName: "Ng", JobType: "Employee", Role: "Engineer"},
+	}, false)
+	addTag := `[{"op":"add","path":"/tags/-","value":"contract"}]`
+
+	// A dry run counts the matching members and changes nothing
+	recorder := send(router, "PATCH", "/api/members?jobtype=contractor&dry_run=true", addTag, "Content-Type", jsonPatchType)
+	result := readBulk(recorder)
+	assert.Equal(t, 200, recorder.Code, "They should be the same")
+	assert.Equal(t, bulkResult{Message: "2 members would be updated", Matched: 2, Changed: 2, DryRun: true}, result, "They should be the same")
+	stored, _ := s.store.Get(ctx, "1")
+	assert.Equal(t, int64(1), stored.Version, "Nothing should have been saved")
+
+	// Every matching member gets the tag
+	recorder = send(router, "PATCH", "/api/members?jobtype=contractor", addTag, "Content-Type", jsonPatchType)
+	assert.Equal(t, bulkResult{Message: "Updated 2 members", Matched: 2, Changed: 2}, readBulk(recorder), "They should be the same")
+	stored, _ = s.store.Get(ctx, "2")
+	assert.Equal(t, []string{"remote", "contract"}, stored.Tags, "They should be the same")
+	stored, _ = s.store.Get(ctx, "3")
+	assert.Empty(t, stored.Tags, "A member that does not match should not change")
+
+	// Members the change does not fit are reported and left as they are
+	recorder = send(router, "PATCH", "/api/members?tag=contract&tag=remote&tag_match=any", `{"duration":null}`, "Content-Type", mergePatchType)
+	result = readBulk(recorder)
+	assert.Equal(t, "Updated 0 members, and 2 members could not be", result.Message, "They should be the same")
+	assert.Equal(t, []string{"1", "2"}, []string{result.Items[0].ID, result.Items[1].ID}, "They should be the same")
+	assert.Equal(t, codeValidationFailed, result.Items[0].Code, "They should be the same")
+	recorder = send(router, "PATCH", "/api/members?tag=remote", `{"lastname":"Jonas"}`, "Content-Type", "application/json")
+	assert.Equal(t, 1, readBulk(recorder).Changed, "They should be the same")
+
+	// The whole request is refused without a filter, or with a body that cannot apply to any member
+	for _, bad := range []struct{ path, body string }{
+		{"/api/members", `{"lastname":"Jonas"}`},
+		{"/api/members?jobtype=contractor", `{"jobtype":"Intern"}`},
+		{"/api/members?jobtype=contractor", `{"lastname":7}`},
+	} {
+		recorder = send(router, "PATCH", bad.path, bad.body, "Content-Type", "application/json")
+		assert.Equal(t, 400, recorder.Code, bad.body)
+	}
+	recorder = send(router, "PATCH", "/api/members?jobtype=contractor", `[{"op":"jump","path":"/tags"}]`, "Content-Type", jsonPatchType)
+	assert.Equal(t, 400, recorder.Code, "They should be the same")
+	recorder = send(router, "PATCH", "/api/members?all=true", `{"lastname":"Same"}`, "Content-Type", mergePatchType)
+	assert.Equal(t, 3, readBulk(recorder).Changed, "They should be the same")
+
+	// Members the change leaves as they were match, but do not count as changed
+	s.store.Modify(ctx, "3", func(m Member) (Member, error) {
+		m.LastName = "Wu"
+		return m, nil
+	})
+	for _, path := range []string{"/api/members?all=true&dry_run=true", "/api/members?all=true"} {
+		recorder = send(router, "PATCH", path, `{"lastname":"Wu"}`, "Content-Type", "application/json")
+		result := readBulk(recorder)
+		assert.Equal(t, []int{3, 2}, []int{result.Matched, result.Changed}, path)
+	}
+	stored, _ = s.store.Get(ctx, "3")
+	ok := assert.Equal(t, int64(3), stored.Version, "A member left as it was should not be saved")
+	if ok {
+		fmt.Println("Successfully updated members in bulk")
+	}
+}
+
+// Try deleting the members that pass a filter
+func TestBulkDelete(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing bulk deletes")
+
+	s, router := newTestServer()
+	deleted := func(path string) bulkResult {
+		recorder := send(router, "DELETE", path, "")
+		assert.Equal(t, 200, recorder.Code, path)
+		return readBulk(recorder)
+	}
+	ctx := context.Background()
+	s.store.CreateMany(ctx, []Member{
+		{ID: "1", FirstName: "Ann", LastName: "Smith", JobType: "Contractor", Duration: "6 months", Tags: []string{"alumni"}},
+		{ID: "2", FirstName: "Bob", LastName: "Jones", JobType: "Employee", Role: "Engineer", Tags: []string{"alumni"}},
+		{ID: "3", FirstName: "Carol", LastName: "Ng", JobType: "Employee", Role: "Engineer"},
+	}, false)
+
+	assert.Equal(t, bulkResult{Message: "2 members would be deleted", Matched: 2, Changed: 2, DryRun: true}, deleted("/api/members?tag=alumni&dry_run=true"), "They should be the same")
+	assert.Equal(t, bulkResult{Message: "3 members would be deleted", Matched: 3, Changed: 3, DryRun: true}, deleted("/api/members?all=true&dry_run=true"), "They should be the same")
+	assert.Equal(t, bulkResult{Message: "Deleted 1 member", Matched: 1, Changed: 1}, deleted("/api/members?tag=alumni&jobtype=employee"), "They should be the same")
+	list, _ := s.store.List(ctx, memberQuery{})
+	assert.Equal(t, "13", joinIDs(list), "They should be the same")
+
+	// An empty, unknown or misspelled filter is refused rather than deleting everything
+	for _, path := range []string{"/api/members?tag=", "/api/members?jobtype=", "/api/members?tags=alumni", "/api/members?limit=1", "/api/members?dry_run=true", "/api/members?tag=alumni&dry_run=yes"} {
+		recorder := send(router, "DELETE", path, "")
+		assert.Equal(t, 400, recorder.Code, path)
+	}
+	list, _ = s.store.List(ctx, memberQuery{})
+	assert.Equal(t, "13", joinIDs(list), "Nothing should have been deleted")
+
+	// Without a query string every member is deleted, as before
+	assert.Equal(t, "Successfully deleted all members", deleted("/api/members").Message, "They should be the same")
+	list, _ = s.store.List(ctx, memberQuery{})
+	ok := assert.Empty(t, list, "They should be the same")
+	if ok {
+		fmt.Println("Successfully deleted members in bulk")
+	}
+}
+
 // Try to empty the Collection again
 func TestEmptyDBAgain(t *testing.T) {
 	fmt.Println("----------------")
 	fmt.Println("Testing emptying collection")
 
-	_, err := collection.DeleteMany(context.Background(), bson.D{})
+	err := testServer.store.DeleteAll(context.Background())
 	if err != nil {
 		log.Fatal(err)
 	}
 	fmt.Println("Successfully deleted all members from the collection again")
 }
 
+// Try using the API before the store has connected
+func TestNotReady(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing requests before the store is ready")
+
+	s := newServer(nil, &uuidV7Generator{})
+	r := newRouter(s)
+
+	recorder := send(r, "GET", "/api/members", "")
+	assert.Equal(t, 503, recorder.Code, "They should be the same")
+	assert.Equal(t, codeUnavailable, readProblem(recorder).Code, "They should be the same")
+
+	recorder = send(r, "GET", "/api/ready", "")
+	assert.Equal(t, 503, recorder.Code, "They should be the same")
+	assert.Equal(t, `{"ready":false}`, readText(recorder))
+
+	s.setStore(newMemoryStore())
+	recorder = send(r, "GET", "/api/ready", "")
+	ok := assert.Equal(t, 200, recorder.Code, "They should be the same")
+	if ok {
+		fmt.Println("Successfully waited for the store to be ready")
+	}
+}
+
+// Check the wait between connection attempts
+func TestBackoff(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing the connection backoff")
+
+	b := backoff{initial: time.Second, max: 5 * time.Second}
+	received := []time.Duration{b.delay(0), b.delay(1), b.delay(2), b.delay(3), b.delay(50)}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+
+	ok := assert.Equal(t, expected, received, "They should be the same")
+	if ok {
+		fmt.Println("Successfully doubled the backoff up to its maximum")
+	}
+}
+
+// Try an error the API has no code for, and check it is logged rather than sent
+func TestInternalError(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing an internal error")
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	recorder := httptest.NewRecorder()
+	printErrorMessage(recorder, errors.New("no such table: members"))
+	problem := readProblem(recorder)
+	assert.Equal(t, 500, recorder.Code, "They should be the same")
+	assert.Equal(t, codeInternal, problem.Code, "They should be the same")
+	assert.NotContains(t, problem.Detail, "members", "The error should not be sent")
+	ok := assert.Contains(t, logged.String(), "no such table: members", "The error should be logged")
+	if ok {
+		fmt.Println("Successfully logged an internal error")
+	}
+}
+
 // Test getting a wrong status code
 func TestBad(t *testing.T) {
 	fmt.Println("----------------")
 	fmt.Println("Testing a bad request; one that 405s")
 
-	testData := []byte(`{"firstname":"Bill"}`)
-	req, _ := http.NewRequest("PUT", "/api/members", bytes.NewBuffer(testData))
-	recorder := httptest.NewRecorder()
-	Router().ServeHTTP(recorder, req)
+	recorder := send(Router(), "PUT", "/api/members", `{"firstname":"Bill"}`)
+	assert.Equal(t, 405, recorder.Code, "They should be the same")
+	assert.Equal(t, "application/problem+json", recorder.Header().Get("Content-Type"), "They should be the same")
+	assert.Equal(t, codeMethodNotAllowed, readProblem(recorder).Code, "They should be the same")
 
-	ok := assert.Equal(t, 405, recorder.Code, "They should be the same")
+	recorder = send(Router(), "GET", "/api/people", "")
+	assert.Equal(t, 404, recorder.Code, "They should be the same")
+	ok := assert.Equal(t, codeNotFound, readProblem(recorder).Code, "They should be the same")
 	if ok {
 		fmt.Println("Successfully failed to send a bad request")
 		fmt.Println("----------------")
@@ -0,0 +1,100 @@
+/*
+	batch.go
+		Provides the reading of batches for POST /api/members:batch and the result it sends back
+		for each member
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+)
+
+// The largest batch body the API reads, and the most members a batch can hold
+const (
+	maxBatchBytes   = 10 << 20
+	maxBatchMembers = 1000
+)
+
+// The media types of a batch sent as one JSON member per line
+var ndjsonTypes = []string{"application/x-ndjson", "application/ndjson", "application/jsonl"}
+
+// The outcome for one member of a batch
+type batchResult struct {
+	// The position of the member in the batch, or among the members a bulk update matched, from 0
+	Index int `json:"index"`
+	// 201 when the member was created, or the status a single POST would have failed with
+	Status int    `json:"status"`
+	ID     string `json:"clid,omitempty"`
+	// Why the member was not created, as in a problem+json body
+	Code   string       `json:"code,omitempty"`
+	Detail string       `json:"detail,omitempty"`
+	Errors []fieldError `json:"errors,omitempty"`
+}
+
+// The body sent back for a batch
+type batchResponse struct {
+	Items []batchResult `json:"items"`
+	// How many members the batch held, how many were created and how many were not
+	Count   int `json:"count"`
+	Created int `json:"created"`
+	Failed  int `json:"failed"`
+}
+
+// Count the created and failed members of a batch
+func newBatchResponse(results []batchResult) batchResponse {
+	response := batchResponse{Items: results, Count: len(results)}
+	for _, result := range results {
+		if result.Status == http.StatusCreated {
+			response.Created++
+		} else {
+			response.Failed++
+		}
+	}
+	return response
+}
+
+// A batch result for a member that could not be read, broke a rule or did not fit a patch
+func failedResult(index int, id string, err error) batchResult {
+	result := batchResult{Index: index, ID: id, Status: http.StatusBadRequest, Code: codeBadRequest, Detail: err.Error()}
+	switch e := err.(type) {
+	case *bodyError:
+		result.Errors = e.fields
+	case validationErrors:
+		result.Code, result.Detail, result.Errors = codeValidationFailed, "The member breaks one or more rules", e
+	case *patchError:
+		result.Status = e.status
+		if e.status == http.StatusConflict {
+			result.Code = codeConflict
+		}
+	}
+	return result
+}
+
+// Split a batch body into the JSON of each member. The body is a JSON array, or one member per line
+// for the NDJSON media types, where blank lines are skipped.
+func splitBatch(contentType string, data []byte) ([]json.RawMessage, error) {
+	var items []json.RawMessage
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if contains(ndjsonTypes, mediaType) {
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			if len(bytes.TrimSpace(line)) > 0 {
+				items = append(items, json.RawMessage(line))
+			}
+		}
+	} else if err := json.Unmarshal(data, &items); err != nil {
+		return nil, &bodyError{status: http.StatusBadRequest, message: "The batch must be a JSON array of members, or one member per line with Content-Type application/x-ndjson"}
+	}
+
+	if len(items) == 0 {
+		return nil, &bodyError{status: http.StatusBadRequest, message: "The batch has no members"}
+	}
+	if len(items) > maxBatchMembers {
+		return nil, &bodyError{status: http.StatusRequestEntityTooLarge, message: fmt.Sprintf("A batch can hold at most %d members", maxBatchMembers)}
+	}
+	return items, nil
+}
@@ -0,0 +1,120 @@
+/*
+	conditional.go
+		Provides the ETags and conditional request headers used to avoid lost updates
+		and to answer repeated GETs for unchanged data with 304 Not Modified
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The strong ETag for a member's current version, such as "3"
+func etag(m Member) string {
+	return `"` + strconv.FormatInt(m.Version, 10) + `"`
+}
+
+// The weak ETag for a page of members in one of its representations, with the link to the next page if there is one.
+// It changes whenever a member is added, changed or removed, when a next page appears or goes away,
+// and differs between representations of the same members.
+func listETag(members []Member, next string, variant string) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\n%s\n", variant, next)
+	for _, m := range members {
+		fmt.Fprintf(h, "%s:%d\n", m.ID, m.Version)
+	}
+	return `W/"` + strconv.FormatUint(h.Sum64(), 16) + `"`
+}
+
+// Name the representation of a list: the JSON envelope or the legacy array, with the fields it holds
+func listVariant(legacy bool, fields []string) string {
+	variant := "json"
+	if legacy {
+		variant = "text"
+	}
+	if fields != nil {
+		variant += ";fields=" + strings.Join(fields, ",")
+	}
+	return variant
+}
+
+// Send the validators a client can use to ask for the resource again only if it changed
+func setValidators(w http.ResponseWriter, tag string, modified time.Time) {
+	w.Header().Set("ETag", tag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// Whether a GET can be answered with 304 Not Modified. If-None-Match is compared weakly and,
+// when it is sent, If-Modified-Since is ignored, as RFC 9110 requires.
+func notModified(r *http.Request, tag string, modified time.Time) bool {
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		for _, t := range strings.Split(header, ",") {
+			t = strings.TrimSpace(t)
+			if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(tag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modified.IsZero() {
+		return false
+	}
+	// HTTP dates only have whole seconds
+	return !modified.Truncate(time.Second).After(since)
+}
+
+// Answer a conditional GET that matched with 304 and no body
+func writeNotModified(w http.ResponseWriter, tag string, modified time.Time) {
+	setValidators(w, tag, modified)
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// Whether an If-Match header holds for the member. An empty header always holds,
+// and * holds for any member that exists. Weak tags never match, as RFC 9110 requires.
+func ifMatch(header string, m Member) bool {
+	if header == "" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the request's If-Match header against the stored member, for use inside Modify
+func checkIfMatch(r *http.Request, m Member) error {
+	if !ifMatch(r.Header.Get("If-Match"), m) {
+		return errVersionMismatch
+	}
+	return nil
+}
+
+// A member that must exist for an If-Match header to hold is reported as a failed precondition
+func preconditionError(r *http.Request, err error) error {
+	if err == errMemberNotFound && r.Header.Get("If-Match") != "" {
+		return errVersionMismatch
+	}
+	return err
+}
+
+// Write a member as JSON along with its ETag and Last-Modified time
+func writeMember(w http.ResponseWriter, status int, m Member) {
+	w.Header().Set("Content-Type", "application/json")
+	setValidators(w, etag(m), m.Modified)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(sentMember(m))
+}
@@ -0,0 +1,241 @@
+/*
+	config.go
+		Loads the runtime configuration for the API.
+
+		Every setting has a default, and can be overridden (lowest to highest precedence) by
+		a YAML or TOML config file, an API_* environment variable, and a command-line flag.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting the server reads at startup
+type Config struct {
+	// Where members are stored: mongo, sqlite, postgres or memory
+	Store string `yaml:"store" toml:"store"`
+	// How the IDs of new members are made: uuidv7, ulid or counter
+	IDGenerator string `yaml:"id_generator" toml:"id_generator"`
+	// What happens to fields a member does not have in a request body: ignore or reject
+	UnknownFields string         `yaml:"unknown_fields" toml:"unknown_fields"`
+	Mongo         MongoConfig    `yaml:"mongo" toml:"mongo"`
+	SQLite        SQLiteConfig   `yaml:"sqlite" toml:"sqlite"`
+	Postgres      PostgresConfig `yaml:"postgres" toml:"postgres"`
+	HTTP          HTTPConfig     `yaml:"http" toml:"http"`
+}
+
+// MongoConfig locates the Mongo collection used by the mongo store
+type MongoConfig struct {
+	URI        string `yaml:"uri" toml:"uri"`
+	Database   string `yaml:"database" toml:"database"`
+	Collection string `yaml:"collection" toml:"collection"`
+}
+
+// SQLiteConfig locates the database file used by the sqlite store
+type SQLiteConfig struct {
+	Path string `yaml:"path" toml:"path"`
+}
+
+// PostgresConfig locates the database used by the postgres store
+type PostgresConfig struct {
+	URL string `yaml:"url" toml:"url"`
+}
+
+// HTTPConfig describes how the API is served.
+// Leaving both CertFile and KeyFile empty serves plain HTTP on Addr with no redirect listener.
+type HTTPConfig struct {
+	Addr         string `yaml:"addr" toml:"addr"`
+	RedirectAddr string `yaml:"redirect_addr" toml:"redirect_addr"`
+	Domain       string `yaml:"domain" toml:"domain"`
+	CertFile     string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile      string `yaml:"key_file" toml:"key_file"`
+}
+
+// The values used when nothing else is provided
+func defaultConfig() Config {
+	return Config{
+		Store:         "mongo",
+		IDGenerator:   "uuidv7",
+		UnknownFields: "ignore",
+		Mongo: MongoConfig{
+			URI:        "mongodb://localhost:27017",
+			Database:   "go-api",
+			Collection: "members",
+		},
+		SQLite:   SQLiteConfig{Path: "members.db"},
+		Postgres: PostgresConfig{URL: "postgres://localhost:5432/go-api"},
+		HTTP: HTTPConfig{
+			Addr:         ":8081",
+			RedirectAddr: ":8082",
+			Domain:       "fuchsli.com",
+			CertFile:     "/etc/letsencrypt/live/fuchsli.com-0003/fullchain.pem",
+			KeyFile:      "/etc/letsencrypt/live/fuchsli.com-0003/privkey.pem",
+		},
+	}
+}
+
+// A single setting and the names it goes by outside of the config file
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	field func(c *Config) *string
+}
+
+var settings = []setting{
+	{"store", "API_STORE", "where members are stored: mongo, sqlite, postgres or memory", func(c *Config) *string { return &c.Store }},
+	{"id-generator", "API_ID_GENERATOR", "how new member IDs are made: uuidv7, ulid or counter", func(c *Config) *string { return &c.IDGenerator }},
+	{"unknown-fields", "API_UNKNOWN_FIELDS", "what happens to unknown fields in a member body: ignore or reject", func(c *Config) *string { return &c.UnknownFields }},
+	{"mongo-uri", "API_MONGO_URI", "MongoDB connection string", func(c *Config) *string { return &c.Mongo.URI }},
+	{"mongo-database", "API_MONGO_DATABASE", "MongoDB database name", func(c *Config) *string { return &c.Mongo.Database }},
+	{"mongo-collection", "API_MONGO_COLLECTION", "MongoDB collection name", func(c *Config) *string { return &c.Mongo.Collection }},
+	{"sqlite-path", "API_SQLITE_PATH", "path to the SQLite database file", func(c *Config) *string { return &c.SQLite.Path }},
+	{"postgres-url", "API_POSTGRES_URL", "PostgreSQL connection URL", func(c *Config) *string { return &c.Postgres.URL }},
+	{"addr", "API_ADDR", "address the API listens on", func(c *Config) *string { return &c.HTTP.Addr }},
+	{"redirect-addr", "API_REDIRECT_ADDR", "address that redirects plain HTTP to HTTPS", func(c *Config) *string { return &c.HTTP.RedirectAddr }},
+	{"domain", "API_DOMAIN", "domain HTTP requests are redirected to", func(c *Config) *string { return &c.HTTP.Domain }},
+	{"cert-file", "API_CERT_FILE", "TLS certificate chain; empty with -key-file to serve plain HTTP", func(c *Config) *string { return &c.HTTP.CertFile }},
+	{"key-file", "API_KEY_FILE", "TLS private key; empty with -cert-file to serve plain HTTP", func(c *Config) *string { return &c.HTTP.KeyFile }},
+}
+
+// Build the configuration from the command-line arguments, the environment and an optional config file.
+// lookupEnv works like os.LookupEnv, so a variable set to an empty string still overrides the file and defaults.
+func loadConfig(args []string, lookupEnv func(string) (string, bool)) (Config, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("api", flag.ContinueOnError)
+	configPath := fs.String("config", "", "path to a YAML or TOML config file (or API_CONFIG)")
+	flagValues := make(map[string]*string)
+	for _, s := range settings {
+		flagValues[s.flag] = fs.String(s.flag, *s.field(&cfg), s.usage+" (or "+s.env+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	// The config file is the lowest precedence after the defaults
+	path := *configPath
+	if path == "" {
+		path, _ = lookupEnv("API_CONFIG")
+	}
+	if path != "" {
+		if err := loadConfigFile(path, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+
+	// Then the environment. A variable that is set but empty counts, so API_CERT_FILE= can clear the default
+	for _, s := range settings {
+		if value, ok := lookupEnv(s.env); ok {
+			*s.field(&cfg) = value
+		}
+	}
+
+	// And finally any flag that was actually provided
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name {
+				*s.field(&cfg) = *flagValues[s.flag]
+			}
+		}
+	})
+
+	return cfg, cfg.validate()
+}
+
+// Decode a YAML or TOML file over the existing configuration, based on its extension
+func loadConfigFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil {
+			return fmt.Errorf("config file %s: %v", path, err)
+		}
+	case ".toml":
+		meta, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return fmt.Errorf("config file %s: %v", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("config file %s: unknown setting %q", path, undecoded[0].String())
+		}
+	default:
+		return fmt.Errorf("config file %s: the extension must be .yaml, .yml or .toml", path)
+	}
+	return nil
+}
+
+// Report every problem with the configuration at once
+func (c Config) validate() error {
+	var problems []string
+
+	switch c.Store {
+	case "mongo":
+		if !strings.HasPrefix(c.Mongo.URI, "mongodb://") && !strings.HasPrefix(c.Mongo.URI, "mongodb+srv://") {
+			problems = append(problems, "the Mongo URI must start with mongodb:// or mongodb+srv://")
+		}
+		if c.Mongo.Database == "" || c.Mongo.Collection == "" {
+			problems = append(problems, "the Mongo database and collection must not be empty")
+		}
+	case "sqlite":
+		if c.SQLite.Path == "" {
+			problems = append(problems, "the SQLite path must not be empty")
+		}
+	case "postgres":
+		if !strings.HasPrefix(c.Postgres.URL, "postgres://") && !strings.HasPrefix(c.Postgres.URL, "postgresql://") {
+			problems = append(problems, "the PostgreSQL URL must start with postgres:// or postgresql://")
+		}
+	case "memory":
+	default:
+		problems = append(problems, fmt.Sprintf("unknown store %q, please provide 'mongo', 'sqlite', 'postgres' or 'memory'", c.Store))
+	}
+
+	if _, err := newIDGenerator(c.IDGenerator); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.UnknownFields != "ignore" && c.UnknownFields != "reject" {
+		problems = append(problems, fmt.Sprintf("unknown_fields must be 'ignore' or 'reject', not %q", c.UnknownFields))
+	}
+
+	if _, _, err := net.SplitHostPort(c.HTTP.Addr); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid addr %q: %v", c.HTTP.Addr, err))
+	}
+	if (c.HTTP.CertFile == "") != (c.HTTP.KeyFile == "") {
+		problems = append(problems, "the cert file and key file must be provided together")
+	}
+	if c.TLS() {
+		if _, _, err := net.SplitHostPort(c.HTTP.RedirectAddr); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid redirect addr %q: %v", c.HTTP.RedirectAddr, err))
+		}
+		if c.HTTP.Domain == "" {
+			problems = append(problems, "the domain must not be empty when serving HTTPS")
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// TLS reports whether the API is served over HTTPS
+func (c Config) TLS() bool {
+	return c.HTTP.CertFile != "" && c.HTTP.KeyFile != ""
+}
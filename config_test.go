@@ -0,0 +1,152 @@
+/*
+	config_test.go
+
+		Checks how the configuration is layered and validated
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Build a lookupEnv function from a map
+func fakeEnv(values map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := values[key]
+		return value, ok
+	}
+}
+
+// Write a config file into a temporary directory
+func writeConfigFile(t *testing.T, name string, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Try loading the configuration with nothing provided
+func TestConfigDefaults(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing the default configuration")
+
+	cfg, err := loadConfig(nil, fakeEnv(nil))
+	assert.NoError(t, err)
+	ok := assert.Equal(t, defaultConfig(), cfg, "They should be the same")
+	if ok {
+		fmt.Println("Successfully loaded the default configuration")
+	}
+}
+
+// Try overriding the same settings from a file, the environment and flags
+func TestConfigPrecedence(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing configuration precedence")
+
+	path := writeConfigFile(t, "api.yaml", `
+store: sqlite
+sqlite:
+  path: from-file.db
+mongo:
+  database: file-db
+http:
+  domain: file.example.com
+`)
+	env := fakeEnv(map[string]string{
+		"API_CONFIG":      path,
+		"API_SQLITE_PATH": "from-env.db",
+		"API_DOMAIN":      "env.example.com",
+	})
+
+	cfg, err := loadConfig([]string{"-domain=flag.example.com"}, env)
+	assert.NoError(t, err)
+	assert.Equal(t, "sqlite", cfg.Store)
+	assert.Equal(t, "file-db", cfg.Mongo.Database)
+	assert.Equal(t, "members", cfg.Mongo.Collection)
+	assert.Equal(t, "from-env.db", cfg.SQLite.Path)
+	ok := assert.Equal(t, "flag.example.com", cfg.HTTP.Domain)
+	if ok {
+		fmt.Println("Successfully layered file, environment and flags")
+	}
+}
+
+// Try loading a TOML file
+func TestConfigTOML(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing a TOML config file")
+
+	path := writeConfigFile(t, "api.toml", `
+store = "memory"
+
+[http]
+addr = ":9000"
+cert_file = ""
+key_file = ""
+`)
+	cfg, err := loadConfig([]string{"-config", path}, fakeEnv(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, ":9000", cfg.HTTP.Addr)
+	ok := assert.False(t, cfg.TLS())
+	if ok {
+		fmt.Println("Successfully loaded a TOML config file")
+	}
+}
+
+// Try clearing the TLS files with empty environment variables
+func TestConfigEmptyEnv(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing empty environment variables")
+
+	cfg, err := loadConfig(nil, fakeEnv(map[string]string{"API_CERT_FILE": "", "API_KEY_FILE": ""}))
+	assert.NoError(t, err)
+	ok := assert.False(t, cfg.TLS(), "Empty cert and key files should serve plain HTTP")
+	if ok {
+		fmt.Println("Successfully cleared the TLS files from the environment")
+	}
+}
+
+// Try choosing the PostgreSQL store from the environment
+func TestConfigPostgres(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing the PostgreSQL settings")
+
+	cfg, err := loadConfig(nil, fakeEnv(map[string]string{"API_STORE": "postgres", "API_POSTGRES_URL": "postgresql://api@db:5432/members"}))
+	assert.NoError(t, err)
+	assert.Equal(t, "postgres", cfg.Store, "They should be the same")
+	ok := assert.Equal(t, "postgresql://api@db:5432/members", cfg.Postgres.URL, "They should be the same")
+	if ok {
+		fmt.Println("Successfully chose the PostgreSQL store")
+	}
+}
+
+// Try loading configurations that should be rejected
+func TestConfigInvalid(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing invalid configurations")
+
+	_, err := loadConfig([]string{"-store=oracle", "-key-file="}, fakeEnv(nil))
+	assert.EqualError(t, err, `invalid configuration: unknown store "oracle", please provide 'mongo', 'sqlite', 'postgres' or 'memory'; the cert file and key file must be provided together`)
+
+	_, err = loadConfig([]string{"-store=postgres", "-postgres-url=localhost:5432"}, fakeEnv(nil))
+	assert.EqualError(t, err, "invalid configuration: the PostgreSQL URL must start with postgres:// or postgresql://")
+
+	_, err = loadConfig(nil, fakeEnv(map[string]string{"API_MONGO_URI": "localhost:27017"}))
+	assert.EqualError(t, err, "invalid configuration: the Mongo URI must start with mongodb:// or mongodb+srv://")
+
+	_, err = loadConfig([]string{"-unknown-fields=drop"}, fakeEnv(nil))
+	assert.EqualError(t, err, `invalid configuration: unknown_fields must be 'ignore' or 'reject', not "drop"`)
+
+	path := writeConfigFile(t, "api.yml", "rich: very\n")
+	_, err = loadConfig([]string{"-config=" + path}, fakeEnv(nil))
+	ok := assert.Error(t, err)
+	if ok {
+		fmt.Println("Successfully rejected invalid configurations")
+	}
+}
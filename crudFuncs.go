@@ -1,174 +1,598 @@
 package main
 
 import (
-	"context"
-	"encoding/json"
-	"fmt"
-	"math/rand"
+	"errors"
+	"mime"
 	"net/http"
-	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
-	"go.mongodb.org/mongo-driver/bson"
 )
 
-// Get a list of all members
-func getMembers(w http.ResponseWriter, r *http.Request) {
-	var members []*Member
+// Get a list of all members, or of those that pass the filters in the query string.
+// The list is sorted by ?sort= and holds only the ?fields= asked for.
+// With a limit the list comes in pages, and a Link header and the next field point to the next one.
+func (s *server) getMembers(w http.ResponseWriter, r *http.Request) {
+	query, err := parseMemberQuery(r.URL.Query())
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
 
-	// Passing nil as the filter matches all documents in the collection
-	cur, err := collection.Find(context.TODO(), bson.D{})
+	// Ask for one more member than the page holds to find out whether there is a next page
+	page := query
+	if page.Limit > 0 {
+		page.Limit++
+	}
+	members, err := s.store.List(r.Context(), page)
 	if err != nil {
 		printErrorMessage(w, err)
 		return
 	}
-	// Close the cursor
-	defer cur.Close(context.TODO())
+	next := ""
+	if query.Limit > 0 && len(members) > query.Limit {
+		members = members[:query.Limit]
+		next = nextPageURL(r.URL, members[len(members)-1], query.Sort)
+		w.Header().Set("Link", "<"+next+`>; rel="next"`)
+	}
 
-	// Iterating through the cursor allows us to find one document at a time
-	for cur.Next(context.TODO()) {
-		// Create a value into which a single document can be decoded
+	// Pollers that already have this list get 304 instead of the whole collection.
+	// A deleted member leaves no change time behind, so the list has an ETag but no Last-Modified.
+	// The JSON envelope, the legacy array and each choice of fields are different bodies with different ETags.
+	legacy := legacyText(w, r)
+	tag := listETag(members, next, listVariant(legacy, query.Fields))
+	if notModified(r, tag, time.Time{}) {
+		writeNotModified(w, tag, time.Time{})
+		return
+	}
+	setValidators(w, tag, time.Time{})
 
-		var member Member
-		err := cur.Decode(&member)
-		if err != nil {
-			printErrorMessage(w, err)
+	sent := make([]Member, len(members))
+	for i, member := range members {
+		sent[i] = sentMember(member)
+	}
+	var items interface{} = sent
+	if query.Fields != nil {
+		projected := make([]map[string]interface{}, len(members))
+		for i, member := range members {
+			projected[i] = projectMember(member, query.Fields)
+		}
+		items = projected
+	}
+
+	// Legacy clients get the bare array, or a message for an empty collection.
+	// An empty filtered list or page is still JSON, so a client showing the results does not have to special-case it.
+	if legacy {
+		if len(members) == 0 && !query.filtered() && query.After == nil {
+			writeLegacyText(w, http.StatusOK, "The collection currently has no members.")
 			return
 		}
-		members = append(members, &member)
+		writeJSON(w, http.StatusOK, items)
+		return
 	}
+	writeJSON(w, http.StatusOK, memberList{Items: items, Count: len(members), Next: next})
+}
 
-	if err := cur.Err(); err != nil {
-		w.Header().Set("Content-Type", "text/html")
-		fmt.Fprintf(w, "The following error occurred: %v", err)
+// Find members by the words in ?q=, most relevant first. A word also matches the start of a longer one.
+func (s *server) searchMembers(w http.ResponseWriter, r *http.Request) {
+	words, limit, err := parseSearch(r.URL.Query())
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
 	}
 
-	if len(members) == 0 {
-		w.Header().Set("Content-Type", "text/html")
-		fmt.Fprintf(w, "The collection currently has no members.")
-	} else {
-		w.Header().Set("Content-Type", "application/json")
-		// Encode as JSON to display in browser
-		json.NewEncoder(w).Encode(members)
+	members, truncated, err := s.store.Search(r.Context(), words, limit)
+	if err != nil {
+		printErrorMessage(w, err)
+		return
+	}
+	sent := make([]Member, len(members))
+	for i, member := range members {
+		sent[i] = sentMember(member)
 	}
+	writeJSON(w, http.StatusOK, memberList{Items: sent, Count: len(members), Truncated: truncated})
 }
 
-// Get a member by ID
-func getMember(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+// Get a member by ID, with only the ?fields= asked for
+func (s *server) getMember(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 
-	// Create a variable into which the resulting member data can be encoded
-	var resultMember Member
-	filter := bson.D{{"clid", params["clid"]}}
-	err := collection.FindOne(context.TODO(), filter).Decode(&resultMember)
+	var fields []string
+	if value := r.URL.Query().Get("fields"); value != "" {
+		var err error
+		if fields, err = parseFields(value); err != nil {
+			writeProblem(w, http.StatusBadRequest, codeBadRequest, err.Error())
+			return
+		}
+	}
+
+	resultMember, err := s.store.Get(r.Context(), params["clid"])
 	if err != nil {
 		printErrorMessage(w, err)
 		return
-	} else {
-		// Encode resultMember as JSON
-		json.NewEncoder(w).Encode(&resultMember)
 	}
+
+	if notModified(r, etag(resultMember), resultMember.Modified) {
+		writeNotModified(w, etag(resultMember), resultMember.Modified)
+		return
+	}
+
+	// Encode resultMember as JSON, with its version as the ETag
+	if fields == nil {
+		writeMember(w, http.StatusOK, resultMember)
+		return
+	}
+	setValidators(w, etag(resultMember), resultMember.Modified)
+	writeJSON(w, http.StatusOK, projectMember(resultMember, fields))
 }
 
-// Create a new member
-func createMember(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/html")
+// How many IDs createMember tries before giving up on finding an unused one
+const maxIDAttempts = 10
+
+// Create a new member and send it back as it was stored, with 201 Created and its URL in the Location header.
+// A provided ID that is already taken is replaced with a generated one and a warning,
+// unless ?strict=true asks for a 409 instead.
+func (s *server) createMember(w http.ResponseWriter, r *http.Request) {
 	outcome := ""
 
-	var member Member
-	_ = json.NewDecoder(r.Body).Decode(&member)
+	member, err := s.decodeMember(w, r)
+	if err != nil {
+		printErrorMessage(w, err)
+		return
+	}
 
 	// The user can provide a custom ID as long as it's unique
+	requestedID := member.ID
 	if member.ID == "" {
-		rand.Seed(time.Now().UTC().UnixNano())
-		member.ID = strconv.Itoa(rand.Intn(99999999))
+		member.ID = s.ids.newID()
 	}
-
-	// Ensure the ID is unique and validate provided information
-	member.ID, outcome = verifyUniqueID(member.ID, outcome)
 	isValidData := validateMemberData(w, member)
 
-	// If the data is valid, insert it into the database
+	// If the data is valid, insert it into the database.
+	// The store refuses an ID already in use, so a taken ID is swapped for a newly generated one.
 	if isValidData {
-		_, err := collection.InsertOne(context.TODO(), member)
+		// In strict mode a taken ID is reported as a conflict instead
+		strict := r.URL.Query().Get("strict") == "true"
+
+		var created Member
+		for attempt := 0; attempt < maxIDAttempts; attempt++ {
+			created, err = s.store.Create(r.Context(), member)
+			if err != errDuplicateID || (strict && member.ID == requestedID) {
+				break
+			}
+			member.ID = s.ids.newID()
+		}
+		if err != nil {
+			printErrorMessage(w, err)
+			return
+		}
+
+		w.Header().Set("Location", memberLocation(created.ID))
+		reassigned := requestedID != "" && created.ID != requestedID
+
+		// Legacy clients get the message and status they always did
+		if legacyText(w, r) {
+			if reassigned {
+				outcome = "The provided ID was not unique, so a unique one with ID " + created.ID + " was created. "
+			}
+			outcome += "Created a new member"
+			writeLegacyText(w, http.StatusOK, outcome)
+			return
+		}
+
+		body := createdMember{Member: sentMember(created)}
+		if reassigned {
+			body.Warning = "The provided ID " + requestedID + " was already in use, so the member was created with ID " + created.ID
+			w.Header().Set("Warning", `299 - "The provided ID was already in use, so another one was generated"`)
+		}
+		setValidators(w, etag(created), created.Modified)
+		writeJSON(w, http.StatusCreated, body)
+	}
+
+}
+
+// Create many members at once from a JSON array, or from one member per line with Content-Type application/x-ndjson.
+// Each member is checked as a single POST would check it, and the valid ones are stored together.
+// The response holds a result for every member. With ?atomic=true a single failure means none are stored.
+func (s *server) createMembers(w http.ResponseWriter, r *http.Request) {
+	data, err := readBodyLimit(w, r, maxBatchBytes)
+	if err != nil {
+		printErrorMessage(w, err)
+		return
+	}
+	items, err := splitBatch(r.Header.Get("Content-Type"), data)
+	if err != nil {
+		printErrorMessage(w, err)
+		return
+	}
+	atomic := r.URL.Query().Get("atomic") == "true"
+
+	// Check every member first, keeping the position of the valid ones in the batch
+	results := make([]batchResult, len(items))
+	var valid []Member
+	var positions []int
+	for i, item := range items {
+		member, err := s.parseMember(item)
+		if err != nil {
+			results[i] = failedResult(i, "", err)
+			continue
+		}
+		if member.ID == "" {
+			member.ID = s.ids.newID()
+		}
+		if errs := memberErrors(member); len(errs) > 0 {
+			results[i] = failedResult(i, member.ID, validationErrors(errs))
+			continue
+		}
+		valid = append(valid, member)
+		positions = append(positions, i)
+	}
+
+	failed := len(valid) < len(items)
+	if len(valid) > 0 && !(atomic && failed) {
+		created, errs, err := s.store.CreateMany(r.Context(), valid, atomic)
 		if err != nil {
 			printErrorMessage(w, err)
 			return
 		}
+		for j, i := range positions {
+			switch errs[j] {
+			case nil:
+				// A failed all-or-nothing batch sends back no members, and these are reported below
+				if created[j].ID != "" {
+					results[i] = batchResult{Index: i, Status: http.StatusCreated, ID: created[j].ID}
+				}
+			case errDuplicateID:
+				results[i] = batchResult{Index: i, Status: http.StatusConflict, ID: valid[j].ID, Code: codeConflict, Detail: "A member with the provided ID already exists"}
+				failed = true
+			default:
+				printErrorMessage(w, errs[j])
+				return
+			}
+		}
+	}
+
+	// An all-or-nothing batch that failed stored nothing, so its valid members are reported as not created either
+	if atomic && failed {
+		for j, i := range positions {
+			if results[i].Status == 0 || results[i].Status == http.StatusCreated {
+				results[i] = batchResult{Index: i, Status: http.StatusFailedDependency, ID: valid[j].ID, Code: codeFailedDependency,
+					Detail: "The member is valid, but was not created because another member of the batch failed"}
+			}
+		}
+		problem := newProblem(http.StatusBadRequest, codeBadRequest, "No members were created because at least one member of the batch failed")
+		problem.Items = results
+		sendProblem(w, problem)
+		return
+	}
+	writeJSON(w, http.StatusOK, newBatchResponse(results))
+}
+
+// Returned for a member that another request changed during a bulk update, so it no longer passes the filters
+var errNoLongerMatches = errors.New("the member no longer passes the filters")
+
+// Apply one change to every member that passes the filters in the query string, such as PATCH /api/members?jobtype=contractor.
+// The body can be in any format PATCH /api/members/{id} accepts. Each member is checked against the rules on its own,
+// and the members the change does not fit are left as they are and reported.
+// A filter is required unless ?all=true, and ?dry_run=true only reports what would change.
+func (s *server) updateMembers(w http.ResponseWriter, r *http.Request) {
+	q, err := parseBulkFilter(r.URL.Query())
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	if !q.filtered() && r.URL.Query().Get("all") != "true" {
+		writeProblem(w, http.StatusBadRequest, codeBadRequest, "A bulk update needs at least one filter, such as ?jobtype=contractor. To update every member, send ?all=true")
+		return
+	}
+
+	body, err := readBody(w, r)
+	if err != nil {
+		printErrorMessage(w, err)
+		return
+	}
+	apply, err := s.memberPatch(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		printErrorMessage(w, err)
+		return
+	}
+	// A malformed patch would fail for every member, so it fails the request instead
+	if _, err := apply(Member{}); err != nil {
+		if pe, ok := err.(*patchError); ok && pe.status == http.StatusBadRequest {
+			printErrorMessage(w, err)
+			return
+		}
+	}
 
-		outcome += "Created a new member"
-		// members = append(members, member)
-		w.Header().Set("Content-Type", "text/html")
-		fmt.Fprintf(w, outcome)
+	members, err := s.store.List(r.Context(), q.filters())
+	if err != nil {
+		printErrorMessage(w, err)
+		return
 	}
 
+	// Each member is read, changed and saved atomically, and skipped if it no longer passes the filters
+	result := bulkResult{DryRun: r.URL.Query().Get("dry_run") == "true"}
+	for i, m := range members {
+		// Set on every attempt, so it describes the member the change was last applied to
+		changed := false
+		change := func(current Member) (Member, error) {
+			if !q.matches(current) {
+				return current, errNoLongerMatches
+			}
+			patched, err := apply(current)
+			if err != nil {
+				return current, err
+			}
+			if errs := memberErrors(patched); len(errs) > 0 {
+				return current, validationErrors(errs)
+			}
+			changed = !unchanged(current, patched)
+			return patched, nil
+		}
+
+		if result.DryRun {
+			_, err = change(m)
+		} else {
+			_, err = s.store.Modify(r.Context(), m.ID, change)
+		}
+		switch err.(type) {
+		case nil:
+			// A member the change leaves as it was only counts as matched
+			result.Matched++
+			if changed {
+				result.Changed++
+			}
+		case validationErrors, *patchError:
+			result.Matched++
+			result.Failed++
+			result.Items = append(result.Items, failedResult(i, m.ID, err))
+		default:
+			if err != errMemberNotFound && err != errNoLongerMatches {
+				printErrorMessage(w, err)
+				return
+			}
+		}
+	}
+
+	result.Message = "Updated " + countMembers(result.Changed)
+	if result.DryRun {
+		result.Message = countMembers(result.Changed) + " would be updated"
+	}
+	if result.Failed > 0 {
+		result.Message += ", and " + countMembers(result.Failed) + " could not be"
+	}
+	writeBulkResult(w, r, result)
 }
 
-// Update member information
-func updateMember(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/html")
+// Update member information.
+// A merge patch (RFC 7386) can also clear fields, and a JSON patch (RFC 6902) can add and remove
+// single tags. Any other body sets the non-empty fields it contains.
+func (s *server) updateMember(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case mergePatchType:
+		apply := mergePatchMember
+		if s.rejectUnknownFields {
+			apply = func(m Member, patch []byte) (Member, error) {
+				if err := unknownFields(patch); err != nil {
+					return m, err
+				}
+				return mergePatchMember(m, patch)
+			}
+		}
+		s.patchMember(w, r, apply)
+		return
+	case jsonPatchType:
+		apply := jsonPatchMember
+		if s.rejectUnknownFields {
+			apply = func(m Member, patch []byte) (Member, error) {
+				if err := unknownPatchFields(patch); err != nil {
+					return m, err
+				}
+				return jsonPatchMember(m, patch)
+			}
+		}
+		s.patchMember(w, r, apply)
+		return
+	}
+
 	params := mux.Vars(r)
-	var member Member
-	var testMember Member
+	member, err := s.decodeMember(w, r)
+	if err != nil {
+		printErrorMessage(w, err)
+		return
+	}
 
-	filter := bson.D{{"clid", params["clid"]}}
+	// Nothing is changed unless every provided field is valid
+	if errs := updateErrors(member); len(errs) > 0 {
+		printValidationErrors(w, errs)
+		return
+	}
 
-	// Test whether or not the given ID matches a member
-	err := collection.FindOne(context.TODO(), filter).Decode(&testMember)
+	// Apply every change in a single write, as long as the member still matches If-Match
+	fields := updateFields(member)
+	updated, err := s.store.Modify(r.Context(), params["clid"], func(current Member) (Member, error) {
+		if err := checkIfMatch(r, current); err != nil {
+			return current, err
+		}
+		err := setMemberFields(&current, fields)
+		return current, err
+	})
 	if err != nil {
-		fmt.Fprintf(w, "No member for the provided ID could be found")
+		printErrorMessage(w, preconditionError(r, err))
 		return
 	}
 
-	_ = json.NewDecoder(r.Body).Decode(&member)
-	var outcome string
+	writeMember(w, http.StatusOK, updated)
+}
+
+// Apply a patch document to the stored member and check the result against every rule.
+// The member is read, patched and saved atomically, so concurrent patches never overwrite each other.
+func (s *server) patchMember(w http.ResponseWriter, r *http.Request, apply func(Member, []byte) (Member, error)) {
+	params := mux.Vars(r)
 
-	// End the update function without updating if a validation error
-	outcome, ok := validateUpdate(w, filter, member, outcome)
-	if !ok {
+	patch, err := readBody(w, r)
+	if err != nil {
+		printErrorMessage(w, err)
 		return
 	}
 
-	if outcome == "" {
-		outcome = "No data was changed"
+	updated, err := s.store.Modify(r.Context(), params["clid"], func(current Member) (Member, error) {
+		if err := checkIfMatch(r, current); err != nil {
+			return current, err
+		}
+		patched, err := apply(current, patch)
+		if err != nil {
+			return current, err
+		}
+		if errs := memberErrors(patched); len(errs) > 0 {
+			return current, validationErrors(errs)
+		}
+		return patched, nil
+	})
+	if err != nil {
+		printErrorMessage(w, preconditionError(r, err))
+		return
 	}
-	fmt.Fprintf(w, outcome)
+
+	writeMember(w, http.StatusOK, updated)
 }
 
-// Deletes a member
-func deleteMember(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/html")
+// Replace a member with the provided document, checked against every rule like a new member.
+// With ?upsert=true a missing member is created, and with If-None-Match: * it is only ever created.
+// If-Match only replaces the member while it has a matching version, so it never creates one.
+func (s *server) replaceMember(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 
-	filter := bson.D{{"clid", params["clid"]}}
+	member, err := s.decodeMember(w, r)
+	if err != nil {
+		printErrorMessage(w, err)
+		return
+	}
+	if member.ID != "" && member.ID != params["clid"] {
+		writeProblem(w, http.StatusBadRequest, codeBadRequest, "The member ID in the body does not match the URL")
+		return
+	}
+	member.ID = params["clid"]
+
+	if !validateMemberData(w, member) {
+		return
+	}
+
+	createOnly := r.Header.Get("If-None-Match") == "*"
+	upsert := createOnly || (r.URL.Query().Get("upsert") == "true" && r.Header.Get("If-Match") == "")
+
+	status := http.StatusOK
+	var saved Member
+	for {
+		if !createOnly {
+			saved, err = s.store.Modify(r.Context(), member.ID, func(current Member) (Member, error) {
+				if err := checkIfMatch(r, current); err != nil {
+					return current, err
+				}
+				return member, nil
+			})
+			if err != errMemberNotFound || !upsert {
+				break
+			}
+		}
 
-	var testMember Member
+		// The member does not exist yet. If another request creates it first, replace that one instead.
+		saved, err = s.store.Create(r.Context(), member)
+		if err == errDuplicateID && !createOnly {
+			continue
+		}
+		status = http.StatusCreated
+		break
+	}
 
-	// Test whether or not the given ID matches a member
-	err := collection.FindOne(context.TODO(), filter).Decode(&testMember)
+	if err == errDuplicateID && createOnly {
+		writeProblem(w, http.StatusPreconditionFailed, codePreconditionFailed, "A member with the provided ID already exists")
+		return
+	}
 	if err != nil {
-		fmt.Fprintf(w, "No member for the provided ID could be found")
+		printErrorMessage(w, preconditionError(r, err))
 		return
 	}
 
+	if status == http.StatusCreated {
+		w.Header().Set("Location", memberLocation(saved.ID))
+	}
+	writeMember(w, status, saved)
+}
+
+// Deletes a member
+func (s *server) deleteMember(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	// With If-Match, only the version that matched may be deleted
+	var version int64
+	if header := r.Header.Get("If-Match"); header != "" {
+		current, err := s.store.Get(r.Context(), params["clid"])
+		if err == nil && !ifMatch(header, current) {
+			err = errVersionMismatch
+		}
+		if err != nil {
+			printErrorMessage(w, preconditionError(r, err))
+			return
+		}
+		version = current.Version
+	}
+
 	// Finds the matching ID and deletes the document
-	_, err = collection.DeleteOne(context.TODO(), filter)
+	err := s.store.Delete(r.Context(), params["clid"], version)
 	if err != nil {
 		printErrorMessage(w, err)
 		return
 	}
-	fmt.Fprintf(w, "Member successfully deleted")
+	writeResult(w, r, actionResult{Message: "Member successfully deleted", ID: params["clid"]})
 }
 
-// Deletes all members
-func deleteMembers(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/html")
-	_, err := collection.DeleteMany(context.Background(), bson.D{})
+// Deletes all members, or only those that pass the filters in the query string, such as ?tag=alumni.
+// Only a request without a query string, or with ?all=true, deletes every member.
+// With ?dry_run=true nothing is deleted, and the response says how many members would be.
+func (s *server) deleteMembers(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	q, err := parseBulkFilter(values)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	all := len(values) == 0 || values.Get("all") == "true"
+	if !q.filtered() && !all {
+		writeProblem(w, http.StatusBadRequest, codeBadRequest, "A filtered delete needs at least one filter, such as ?tag=alumni. To delete every member, send ?all=true")
+		return
+	}
+	dryRun := values.Get("dry_run") == "true"
+
+	if dryRun {
+		// Only the IDs are needed to count the members
+		count := q.filters()
+		count.Fields = []string{"clid"}
+		members, err := s.store.List(r.Context(), count)
+		if err != nil {
+			printErrorMessage(w, err)
+			return
+		}
+		n := len(members)
+		writeBulkResult(w, r, bulkResult{Message: countMembers(n) + " would be deleted", Matched: n, Changed: n, DryRun: true})
+		return
+	}
+
+	if !q.filtered() {
+		err := s.store.DeleteAll(r.Context())
+		if err != nil {
+			printErrorMessage(w, err)
+			return
+		}
+		writeResult(w, r, actionResult{Message: "Successfully deleted all members"})
+		return
+	}
+
+	n, err := s.store.DeleteMatching(r.Context(), q)
 	if err != nil {
 		printErrorMessage(w, err)
 		return
 	}
-	fmt.Fprintf(w, "Successfully deleted all members")
+	writeBulkResult(w, r, bulkResult{Message: "Deleted " + countMembers(n), Matched: n, Changed: n})
 }
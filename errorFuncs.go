@@ -1,20 +1,128 @@
 /*
 	errorFuncs.go
-		Provides custom error-handling functions for the API
+		Provides custom error-handling functions for the API.
+
+		Every failed request is answered with an RFC 7807 problem+json body and a matching HTTP status.
 */
 
 package main
 
 import (
-	"fmt"
+	"encoding/json"
 	"log"
 	"net/http"
+	"strings"
+)
+
+// Machine-readable codes for the kinds of failure a client can tell apart
+const (
+	codeBadRequest         = "bad_request"
+	codeValidationFailed   = "validation_failed"
+	codeNotFound           = "not_found"
+	codeMethodNotAllowed   = "method_not_allowed"
+	codeConflict           = "conflict"
+	codePreconditionFailed = "precondition_failed"
+	codeTooLarge           = "too_large"
+	codeFailedDependency   = "failed_dependency"
+	codeUnavailable        = "unavailable"
+	codeInternal           = "internal"
 )
 
-// Return an error without killing the program
+// The problem+json body written for every error
+type apiError struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Code   string `json:"code"`
+	Detail string `json:"detail,omitempty"`
+	// Every broken rule, when the request failed validation
+	Errors []fieldError `json:"errors,omitempty"`
+	// The result for each member, when an all-or-nothing batch failed
+	Items []batchResult `json:"items,omitempty"`
+}
+
+// Create the problem for the provided status, code and message
+func newProblem(status int, code string, detail string) apiError {
+	return apiError{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   code,
+		Detail: detail,
+	}
+}
+
+// Write a problem+json response with the provided status, code and message
+func writeProblem(w http.ResponseWriter, status int, code string, detail string) {
+	sendProblem(w, newProblem(status, code, detail))
+}
+
+// Write a problem+json response
+func sendProblem(w http.ResponseWriter, problem apiError) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// Return an error without killing the program. Store, patch, body and validation errors are mapped to their status codes,
+// and any other error is logged and answered with a 500 that does not include it.
 func printErrorMessage(w http.ResponseWriter, err error) {
-	w.Header().Set("Content-Type", "text/html")
-	fmt.Fprintf(w, "The following error occurred: %v", err)
+	switch e := err.(type) {
+	case validationErrors:
+		printValidationErrors(w, e)
+		return
+	case *patchError:
+		code := codeBadRequest
+		if e.status == http.StatusConflict {
+			code = codeConflict
+		}
+		writeProblem(w, e.status, code, e.message)
+		return
+	case *bodyError:
+		problem := newProblem(e.status, codeBadRequest, e.message)
+		if e.status == http.StatusRequestEntityTooLarge {
+			problem.Code = codeTooLarge
+		}
+		problem.Errors = e.fields
+		sendProblem(w, problem)
+		return
+	}
+
+	switch err {
+	case errMemberNotFound:
+		writeProblem(w, http.StatusNotFound, codeNotFound, "No member for the provided ID could be found")
+	case errDuplicateID:
+		writeProblem(w, http.StatusConflict, codeConflict, "A member with the provided ID already exists")
+	case errVersionMismatch:
+		writeProblem(w, http.StatusPreconditionFailed, codePreconditionFailed, "The member has changed since it was read. Get it again and retry with its new ETag")
+	case errWriteConflict:
+		writeProblem(w, http.StatusConflict, codeConflict, "The member was changed by another request, please try again")
+	default:
+		// Driver and SQL errors can name tables, hosts or data, so they are only logged on the server
+		log.Printf("Internal error: %v", err)
+		writeProblem(w, http.StatusInternalServerError, codeInternal, "Something went wrong on the server. Please try again later")
+	}
+}
+
+// Answer a request for a path the API does not have
+func routeNotFound(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, http.StatusNotFound, codeNotFound, "The API has no "+r.URL.Path)
+}
+
+// Answer a request with a method the path does not support
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, r.Method+" is not supported for "+r.URL.Path)
+}
+
+// Reject data that breaks member rules, listing every one of them
+func printValidationErrors(w http.ResponseWriter, errs []fieldError) {
+	messages := make([]string, len(errs))
+	for i, e := range errs {
+		messages[i] = e.Message
+	}
+	problem := newProblem(http.StatusBadRequest, codeValidationFailed, strings.Join(messages, "; "))
+	problem.Errors = errs
+	sendProblem(w, problem)
 }
 
 // Something really bad happened and the program needs to end
@@ -0,0 +1,151 @@
+/*
+	idgen.go
+		Provides the generators for the IDs of new members.
+
+		Generated IDs are not checked against the store first. The store refuses a duplicate ID
+		(a unique index in MongoDB, the primary key in SQL), and createMember then asks for another one.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Creates IDs for new members. Implementations are safe to use from concurrent requests.
+type idGenerator interface {
+	newID() string
+}
+
+// The generator for the configured kind: uuidv7, ulid or counter
+func newIDGenerator(kind string) (idGenerator, error) {
+	switch kind {
+	case "uuidv7":
+		return &uuidV7Generator{}, nil
+	case "ulid":
+		return &ulidGenerator{}, nil
+	case "counter":
+		return &counterGenerator{}, nil
+	}
+	return nil, fmt.Errorf("unknown ID generator %q, please provide 'uuidv7', 'ulid' or 'counter'", kind)
+}
+
+// Let a generator that continues from the stored IDs see them before the first member is created
+func seedIDs(ctx context.Context, ids idGenerator, store MemberStore) error {
+	if counter, ok := ids.(*counterGenerator); ok {
+		return counter.seed(ctx, store)
+	}
+	return nil
+}
+
+// A 48-bit millisecond timestamp followed by random bits, as both UUIDv7 and ULID start.
+// Within the same millisecond the random bits are raised by one instead, so IDs from one
+// generator always sort in the order they were made.
+type timeOrdered struct {
+	mu     sync.Mutex
+	millis uint64
+	last   [16]byte
+}
+
+// The next 16 bytes: the timestamp in the first 6, and random or incremented bits in the rest
+func (t *timeOrdered) next() [16]byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	millis := uint64(time.Now().UnixMilli())
+	if millis <= t.millis {
+		// Same millisecond, or the clock went back: count up from the last ID
+		for i := 15; i >= 6; i-- {
+			t.last[i]++
+			if t.last[i] != 0 {
+				break
+			}
+		}
+		return t.last
+	}
+
+	t.millis = millis
+	var id [16]byte
+	var stamp [8]byte
+	binary.BigEndian.PutUint64(stamp[:], millis)
+	copy(id[:6], stamp[2:])
+	if _, err := rand.Read(id[6:]); err != nil {
+		panic(err)
+	}
+	// Leave room to count up within the millisecond
+	id[6] &= 0x7f
+	t.last = id
+	return id
+}
+
+// RFC 9562 version 7 UUIDs, such as 018e4f6c-1f4a-7b3c-8d2e-5f6a7b8c9d0e
+type uuidV7Generator struct {
+	timeOrdered
+}
+
+func (g *uuidV7Generator) newID() string {
+	id := g.next()
+	// The version and variant bits replace some of the random bits
+	id[6] = 0x70 | id[6]&0x0f
+	id[8] = 0x80 | id[8]&0x3f
+
+	s := hex.EncodeToString(id[:])
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+// ULIDs, 26 characters of Crockford's base32 such as 01HQ9Z3J5K8M2N4P6R7S9T0V1W
+type ulidGenerator struct {
+	timeOrdered
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func (g *ulidGenerator) newID() string {
+	id := g.next()
+
+	// 128 bits written as 26 five-bit characters, with two zero bits in front
+	out := make([]byte, 26)
+	for i := range out {
+		value := 0
+		for bit := 5*i - 2; bit < 5*i+3; bit++ {
+			value <<= 1
+			if bit >= 0 && id[bit/8]&(0x80>>(bit%8)) != 0 {
+				value |= 1
+			}
+		}
+		out[i] = crockford[value]
+	}
+	return string(out)
+}
+
+// Numbers counting up from one more than the highest numeric ID in the store.
+// Only suited to a single API instance; several would hand out the same numbers and have to retry.
+type counterGenerator struct {
+	last atomic.Uint64
+}
+
+func (g *counterGenerator) newID() string {
+	return strconv.FormatUint(g.last.Add(1), 10)
+}
+
+// Continue after the highest numeric ID already in the store
+func (g *counterGenerator) seed(ctx context.Context, store MemberStore) error {
+	members, err := store.List(ctx, memberQuery{})
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		if n, err := strconv.ParseUint(m.ID, 10, 64); err == nil && n > g.last.Load() {
+			g.last.Store(n)
+		}
+	}
+	return nil
+}
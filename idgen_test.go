@@ -0,0 +1,104 @@
+/*
+	idgen_test.go
+
+		Checks the format and ordering of generated member IDs
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Generate IDs from many goroutines at once
+func concurrentIDs(g idGenerator, n int) []string {
+	ids := make([]string, n)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i] = g.newID()
+		}(i)
+	}
+	wg.Wait()
+	return ids
+}
+
+// Try each generator from concurrent requests. No two IDs may be the same.
+func TestIDGenerators(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing the ID generators")
+
+	formats := map[string]*regexp.Regexp{
+		"uuidv7":  regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`),
+		"ulid":    regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`),
+		"counter": regexp.MustCompile(`^[1-9][0-9]*$`),
+	}
+	for kind, format := range formats {
+		g, err := newIDGenerator(kind)
+		assert.NoError(t, err, kind)
+
+		seen := map[string]bool{}
+		for _, id := range concurrentIDs(g, 1000) {
+			assert.Regexp(t, format, id, kind)
+			assert.False(t, seen[id], kind+" made "+id+" twice")
+			seen[id] = true
+		}
+	}
+
+	_, err := newIDGenerator("random")
+	ok := assert.Error(t, err, "An unknown generator should be refused")
+	if ok {
+		fmt.Println("Successfully generated unique IDs")
+	}
+}
+
+// Try generating time-ordered IDs one after the other. They should sort in the order they were made.
+func TestIDsSortInOrder(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing the order of time-ordered IDs")
+
+	for _, g := range []idGenerator{&uuidV7Generator{}, &ulidGenerator{}} {
+		ids := make([]string, 1000)
+		for i := range ids {
+			ids[i] = g.newID()
+		}
+		assert.True(t, sort.StringsAreSorted(ids), "The IDs should be sorted")
+	}
+
+	// The same timestamp and random bits give the same ULID as the reference implementation
+	g := &ulidGenerator{}
+	g.millis = 1<<48 - 1
+	g.last = [16]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	ok := assert.Equal(t, "7ZZZZZZZZZ0000000000000001", g.newID(), "They should be the same")
+	if ok {
+		fmt.Println("Successfully ordered generated IDs")
+	}
+}
+
+// Try continuing the counter from the IDs already stored
+func TestCounterSeed(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing seeding the counter from the store")
+
+	ctx := context.Background()
+	store := newMemoryStore()
+	for _, id := range []string{"17", "3", "not-a-number"} {
+		store.Create(ctx, Member{ID: id})
+	}
+
+	g, _ := newIDGenerator("counter")
+	assert.NoError(t, seedIDs(ctx, g, store))
+	ok := assert.Equal(t, "18", g.newID(), "They should be the same")
+	if ok {
+		fmt.Println("Successfully continued the counter after the stored IDs")
+	}
+}
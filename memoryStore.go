@@ -0,0 +1,274 @@
+/*
+	memoryStore.go
+		Provides an in-memory implementation of MemberStore for tests and local development
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Keeps members in a map guarded by a mutex. Nothing survives a restart.
+type memoryStore struct {
+	mu      sync.RWMutex
+	members map[string]Member
+	// The search index: the IDs of the members with each word, and every word in order,
+	// so the words starting with a search word are next to each other
+	terms  map[string]map[string]bool
+	sorted []string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{members: make(map[string]Member), terms: make(map[string]map[string]bool)}
+}
+
+// Save a member and index its words, replacing the member it had before. The lock must be held.
+func (s *memoryStore) put(m Member) {
+	if old, ok := s.members[m.ID]; ok {
+		s.unindex(old)
+	}
+	s.members[m.ID] = cloneMember(m)
+	for _, term := range memberTerms(m) {
+		if s.terms[term] == nil {
+			s.terms[term] = make(map[string]bool)
+			i := sort.SearchStrings(s.sorted, term)
+			s.sorted = append(s.sorted[:i], append([]string{term}, s.sorted[i:]...)...)
+		}
+		s.terms[term][m.ID] = true
+	}
+}
+
+// Remove a member's words from the search index. The lock must be held.
+func (s *memoryStore) unindex(m Member) {
+	for _, term := range memberTerms(m) {
+		delete(s.terms[term], m.ID)
+		if len(s.terms[term]) == 0 {
+			delete(s.terms, term)
+			i := sort.SearchStrings(s.sorted, term)
+			s.sorted = append(s.sorted[:i], s.sorted[i+1:]...)
+		}
+	}
+}
+
+// Copy the tags so callers can never modify a stored member
+func cloneMember(m Member) Member {
+	if m.Tags != nil {
+		m.Tags = append([]string{}, m.Tags...)
+	}
+	return m
+}
+
+// Get a member by ID
+func (s *memoryStore) Get(ctx context.Context, clid string) (Member, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	member, ok := s.members[clid]
+	if !ok {
+		return Member{}, errMemberNotFound
+	}
+	return cloneMember(member), nil
+}
+
+// Get a page of the members that pass the filters
+func (s *memoryStore) List(ctx context.Context, q memberQuery) ([]Member, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := q.sortKeys()
+	var members []Member
+	for _, member := range s.members {
+		if q.After != nil && comparePosition(member, keys, q.After) <= 0 {
+			continue
+		}
+		if q.matches(member) {
+			members = append(members, cloneMember(member))
+		}
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return comparePosition(members[i], keys, sortPosition(members[j], keys)) < 0
+	})
+	if q.Limit > 0 && len(members) > q.Limit {
+		members = members[:q.Limit]
+	}
+	return members, nil
+}
+
+// Find the members with a word starting with each of the provided words, most relevant first
+func (s *memoryStore) Search(ctx context.Context, words []string, limit int) ([]Member, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Start with the members matching the first word, and keep those that match every other one
+	var found map[string]bool
+	for _, word := range words {
+		matching := make(map[string]bool)
+		for i := sort.SearchStrings(s.sorted, word); i < len(s.sorted) && strings.HasPrefix(s.sorted[i], word); i++ {
+			for id := range s.terms[s.sorted[i]] {
+				if found == nil || found[id] {
+					matching[id] = true
+				}
+			}
+		}
+		found = matching
+	}
+
+	var ids []string
+	for id := range found {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if len(ids) > maxSearchCandidates+1 {
+		ids = ids[:maxSearchCandidates+1]
+	}
+	members := make([]Member, len(ids))
+	for i, id := range ids {
+		members[i] = cloneMember(s.members[id])
+	}
+	ranked, truncated := rankCandidates(members, words, limit)
+	return ranked, truncated, nil
+}
+
+// Add a new member. The ID must not already be in use.
+func (s *memoryStore) Create(ctx context.Context, m Member) (Member, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.members[m.ID]; ok {
+		return Member{}, errDuplicateID
+	}
+	m.Version = 1
+	m.Modified = modifiedNow()
+	s.put(m)
+	return cloneMember(m), nil
+}
+
+// Add several new members while holding the lock, so an atomic batch is never seen half saved
+func (s *memoryStore) CreateMany(ctx context.Context, members []Member, atomic bool) ([]Member, []error, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	errs := make([]error, len(members))
+	failed := false
+	seen := make(map[string]bool, len(members))
+	for i, m := range members {
+		if _, ok := s.members[m.ID]; ok || seen[m.ID] {
+			errs[i] = errDuplicateID
+			failed = true
+		}
+		seen[m.ID] = true
+	}
+	if atomic && failed {
+		return make([]Member, len(members)), errs, nil
+	}
+
+	created := make([]Member, len(members))
+	for i, m := range members {
+		if errs[i] != nil {
+			continue
+		}
+		m.Version = 1
+		m.Modified = modifiedNow()
+		s.put(m)
+		created[i] = cloneMember(m)
+	}
+	return created, errs, nil
+}
+
+// Read, change and save a member while holding the lock
+func (s *memoryStore) Modify(ctx context.Context, clid string, fn func(Member) (Member, error)) (Member, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.members[clid]
+	if !ok {
+		return Member{}, errMemberNotFound
+	}
+	updated, err := fn(cloneMember(current))
+	if err != nil {
+		return Member{}, err
+	}
+	if unchanged(current, updated) {
+		return cloneMember(current), nil
+	}
+	updated.ID = clid
+	updated.Version = current.Version + 1
+	updated.Modified = modifiedNow()
+	s.put(updated)
+	return updated, nil
+}
+
+// Delete the member with a matching ID and version
+func (s *memoryStore) Delete(ctx context.Context, clid string, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	member, ok := s.members[clid]
+	if !ok {
+		return errMemberNotFound
+	}
+	if version != 0 && member.Version != version {
+		return errVersionMismatch
+	}
+	s.unindex(member)
+	delete(s.members, clid)
+	return nil
+}
+
+// Delete every member that passes the filters
+func (s *memoryStore) DeleteMatching(ctx context.Context, q memberQuery) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for clid, m := range s.members {
+		if q.matches(m) {
+			s.unindex(m)
+			delete(s.members, clid)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// Delete every member
+func (s *memoryStore) DeleteAll(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.members = make(map[string]Member)
+	s.terms = make(map[string]map[string]bool)
+	s.sorted = nil
+	return nil
+}
+
+// Apply fields keyed by their stored names to a member
+func setMemberFields(m *Member, fields map[string]interface{}) error {
+	for key, value := range fields {
+		var ok bool
+		switch key {
+		case "firstname":
+			m.FirstName, ok = value.(string)
+		case "lastname":
+			m.LastName, ok = value.(string)
+		case "jobtype":
+			m.JobType, ok = value.(string)
+		case "role":
+			m.Role, ok = value.(string)
+		case "duration":
+			m.Duration, ok = value.(string)
+		case "tags":
+			m.Tags, ok = value.([]string)
+		}
+		if !ok {
+			return fmt.Errorf("cannot set field %q to %v", key, value)
+		}
+	}
+	return nil
+}
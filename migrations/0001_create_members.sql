@@ -0,0 +1,16 @@
+-- Members and their tags. Tags live in their own table so a member can have any number of them.
+CREATE TABLE members (
+    clid      TEXT PRIMARY KEY,
+    firstname TEXT NOT NULL,
+    lastname  TEXT NOT NULL,
+    jobtype   TEXT NOT NULL,
+    role      TEXT NOT NULL DEFAULT '',
+    duration  TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE member_tags (
+    clid     TEXT NOT NULL REFERENCES members (clid),
+    position INTEGER NOT NULL,
+    tag      TEXT NOT NULL,
+    PRIMARY KEY (clid, position)
+);
@@ -0,0 +1,2 @@
+-- Every change to a member raises its version, so clients can tell when their copy is stale.
+ALTER TABLE members ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
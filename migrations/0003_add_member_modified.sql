@@ -0,0 +1,3 @@
+-- When each member last changed, in milliseconds since the Unix epoch. Members saved before this are 0.
+-- BIGINT, because PostgreSQL's INTEGER only holds 32 bits; SQLite stores both the same way.
+ALTER TABLE members ADD COLUMN modified BIGINT NOT NULL DEFAULT 0;
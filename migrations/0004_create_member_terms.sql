@@ -0,0 +1,9 @@
+-- The search index: one row for every word a member can be found by, as memberTerms reads them.
+-- Members saved before this are indexed by the store when it opens.
+CREATE TABLE member_terms (
+    clid TEXT NOT NULL REFERENCES members (clid),
+    term TEXT NOT NULL,
+    PRIMARY KEY (clid, term)
+);
+
+CREATE INDEX member_terms_term ON member_terms (term);
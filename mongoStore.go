@@ -0,0 +1,467 @@
+/*
+	mongoStore.go
+		Provides the MongoDB implementation of MemberStore
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// Stores members as documents in a single Mongo collection
+type mongoStore struct {
+	collection *mongo.Collection
+}
+
+// A member as it is saved, with the words it can be searched by.
+// Reading a document into a Member leaves the words out.
+type mongoMember struct {
+	Member `bson:",inline"`
+	Terms  []string `bson:"terms"`
+}
+
+func newMongoStore(collection *mongo.Collection) *mongoStore {
+	return &mongoStore{collection: collection}
+}
+
+// How long to wait between connection attempts
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+}
+
+var defaultBackoff = backoff{initial: 500 * time.Millisecond, max: 30 * time.Second}
+
+// The wait before the given retry, doubling from initial up to max
+func (b backoff) delay(retry int) time.Duration {
+	d := b.initial
+	for i := 0; i < retry && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		d = b.max
+	}
+	return d
+}
+
+// Connect to MongoDB, retrying until the server answers a ping or ctx is done
+func connectMongoStore(ctx context.Context, cfg MongoConfig, retry backoff) (*mongoStore, error) {
+	opts := options.Client().ApplyURI(cfg.URI).SetServerSelectionTimeout(5 * time.Second)
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		err = client.Ping(pingCtx, readpref.Primary())
+		cancel()
+		if err == nil {
+			break
+		}
+
+		wait := retry.delay(attempt)
+		log.Printf("Could not reach MongoDB (attempt %d): %v. Retrying in %v", attempt+1, err, wait)
+		select {
+		case <-ctx.Done():
+			client.Disconnect(context.Background())
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+
+	log.Println("Connected to MongoDB")
+	store := newMongoStore(client.Database(cfg.Database).Collection(cfg.Collection))
+	if err := store.ensureIndexes(ctx); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Create the unique index on clid, so two members can never share an ID, and the search index on the
+// words of each member. Creating an index that already exists does nothing.
+func (s *mongoStore) ensureIndexes(ctx context.Context) error {
+	_, err := s.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "clid", Value: 1}},
+		Options: options.Index().SetUnique(true).SetName("clid_unique"),
+	})
+	if err != nil {
+		// Most likely members already share an ID, and have to be fixed by hand first
+		return fmt.Errorf("could not create the unique index on clid, check for members with the same clid: %v", err)
+	}
+
+	// A text index only matches whole words, so the words are kept in an ordinary index that can match their start
+	_, err = s.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "terms", Value: 1}},
+		Options: options.Index().SetName("terms_search"),
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.unsetEmptyFields(ctx); err != nil {
+		return err
+	}
+	return s.indexTerms(ctx)
+}
+
+// The fields Create leaves out of a document when they are empty
+var omittedWhenEmpty = []string{"role", "duration"}
+
+// Remove the empty roles and durations earlier versions of Modify saved as "", so every empty one
+// is stored the way Create stores it
+func (s *mongoStore) unsetEmptyFields(ctx context.Context) error {
+	for _, field := range omittedWhenEmpty {
+		unset := bson.D{{Key: "$unset", Value: bson.D{{Key: field, Value: ""}}}}
+		if _, err := s.collection.UpdateMany(ctx, bson.D{{Key: field, Value: ""}}, unset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Build the update that saves fields, with the $set of the provided values. An empty role or duration
+// is removed rather than saved as "", since a missing field sorts before "" and paging treats both as "".
+func fieldsUpdate(set bson.D, fields map[string]interface{}) bson.D {
+	unset := bson.D{}
+	for key, value := range fields {
+		if contains(omittedWhenEmpty, key) && value == "" {
+			unset = append(unset, bson.E{Key: key, Value: ""})
+			continue
+		}
+		set = append(set, bson.E{Key: key, Value: value})
+	}
+	update := bson.D{{Key: "$set", Value: set}}
+	if len(unset) > 0 {
+		update = append(update, bson.E{Key: "$unset", Value: unset})
+	}
+	return update
+}
+
+// Save the words of documents that have none yet, such as those saved before search existed
+func (s *mongoStore) indexTerms(ctx context.Context) error {
+	cur, err := s.collection.Find(ctx, bson.D{{Key: "terms", Value: bson.D{{Key: "$exists", Value: false}}}})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var member Member
+		if err := cur.Decode(&member); err != nil {
+			return err
+		}
+		set := bson.D{{Key: "$set", Value: bson.D{{Key: "terms", Value: memberTerms(member)}}}}
+		if _, err := s.collection.UpdateOne(ctx, clidFilter(member.ID), set); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// Filter matching the document with the provided ID
+func clidFilter(clid string) bson.D {
+	return bson.D{{Key: "clid", Value: clid}}
+}
+
+// Get a member by ID
+func (s *mongoStore) Get(ctx context.Context, clid string) (Member, error) {
+	var member Member
+	err := s.collection.FindOne(ctx, clidFilter(clid)).Decode(&member)
+	if err == mongo.ErrNoDocuments {
+		return member, errMemberNotFound
+	}
+	return member, err
+}
+
+// Get a page of the members that pass the filters, in the requested order
+func (s *mongoStore) List(ctx context.Context, q memberQuery) ([]Member, error) {
+	sort := bson.D{}
+	for _, k := range q.sortKeys() {
+		direction := 1
+		if k.Desc {
+			direction = -1
+		}
+		sort = append(sort, bson.E{Key: k.Field, Value: direction})
+	}
+	opts := options.Find().SetSort(sort)
+	if q.Limit > 0 {
+		opts.SetLimit(int64(q.Limit))
+	}
+	if q.Fields != nil {
+		// The sort fields are needed for the next cursor, and the version and time for the ETag
+		projection := bson.D{{Key: "version", Value: 1}, {Key: "modified", Value: 1}}
+		for _, field := range q.Fields {
+			projection = append(projection, bson.E{Key: field, Value: 1})
+		}
+		for _, k := range q.sortKeys() {
+			projection = append(projection, bson.E{Key: k.Field, Value: 1})
+		}
+		opts.SetProjection(dedupeKeys(projection))
+	}
+	cur, err := s.collection.Find(ctx, queryFilter(q), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var members []Member
+	if err := cur.All(ctx, &members); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// Find the members with a word starting with each of the provided words, most relevant first.
+// The terms index finds the members, and rankCandidates orders them.
+func (s *mongoStore) Search(ctx context.Context, words []string, limit int) ([]Member, bool, error) {
+	var and bson.A
+	for _, word := range words {
+		// A regex anchored at the start of the word can use the index
+		prefix := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(word)}
+		and = append(and, bson.D{{Key: "terms", Value: prefix}})
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "clid", Value: 1}}).SetLimit(maxSearchCandidates + 1)
+	cur, err := s.collection.Find(ctx, bson.D{{Key: "$and", Value: and}}, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	defer cur.Close(ctx)
+
+	var members []Member
+	if err := cur.All(ctx, &members); err != nil {
+		return nil, false, err
+	}
+	ranked, truncated := rankCandidates(members, words, limit)
+	return ranked, truncated, nil
+}
+
+// Translate the filters into a Mongo filter. No filters gives an empty one, which matches every document.
+func queryFilter(q memberQuery) bson.D {
+	filter := bson.D{}
+	if q.JobType != "" {
+		// The job type is compared without regard to case, like the validation rules do
+		pattern := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(q.JobType) + "$", Options: "i"}
+		filter = append(filter, bson.E{Key: "jobtype", Value: pattern})
+	}
+	if q.Role != "" {
+		filter = append(filter, bson.E{Key: "role", Value: q.Role})
+	}
+	if q.Duration != "" {
+		filter = append(filter, bson.E{Key: "duration", Value: q.Duration})
+	}
+	if q.After != nil {
+		filter = append(filter, bson.E{Key: "$or", Value: afterFilter(q.sortKeys(), q.After)})
+	}
+	if len(q.Tags) > 0 {
+		operator := "$in"
+		if q.AllTags {
+			operator = "$all"
+		}
+		filter = append(filter, bson.E{Key: "tags", Value: bson.D{{Key: operator, Value: q.Tags}}})
+	}
+	return filter
+}
+
+// Match the members after a position in the sort order: those greater in the first key,
+// or equal in the first and greater in the second, and so on.
+// Empty roles and durations are left out of the documents by every write, so a missing field counts as "".
+func afterFilter(keys []sortKey, position []string) bson.A {
+	or := bson.A{}
+	for i, k := range keys {
+		clause := bson.D{}
+		for j := 0; j < i; j++ {
+			equal := interface{}(position[j])
+			if position[j] == "" {
+				equal = bson.D{{Key: "$in", Value: bson.A{"", nil}}}
+			}
+			clause = append(clause, bson.E{Key: keys[j].Field, Value: equal})
+		}
+		after := bson.D{{Key: "$gt", Value: position[i]}}
+		if k.Desc {
+			// Missing fields sort last in descending order, so they come after any value but ""
+			after = bson.D{{Key: "$not", Value: bson.D{{Key: "$gte", Value: position[i]}}}}
+			if position[i] == "" {
+				after = bson.D{{Key: "$lt", Value: ""}}
+			}
+		}
+		clause = append(clause, bson.E{Key: k.Field, Value: after})
+		or = append(or, clause)
+	}
+	return or
+}
+
+// Drop repeated keys from a projection, which Mongo refuses
+func dedupeKeys(doc bson.D) bson.D {
+	seen := map[string]bool{}
+	result := bson.D{}
+	for _, e := range doc {
+		if !seen[e.Key] {
+			seen[e.Key] = true
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// Insert a new member document. The unique index refuses an ID already in use.
+func (s *mongoStore) Create(ctx context.Context, m Member) (Member, error) {
+	m.Version = 1
+	m.Modified = modifiedNow()
+	if _, err := s.collection.InsertOne(ctx, mongoMember{Member: m, Terms: memberTerms(m)}); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return Member{}, errDuplicateID
+		}
+		return Member{}, err
+	}
+	return m, nil
+}
+
+// Insert several member documents in one unordered InsertMany, so a taken ID only fails that member.
+// An atomic batch runs in a transaction, which needs MongoDB to run as a replica set.
+func (s *mongoStore) CreateMany(ctx context.Context, members []Member, atomic bool) ([]Member, []error, error) {
+	created := make([]Member, len(members))
+	docs := make([]interface{}, len(members))
+	for i, m := range members {
+		m.Version = 1
+		m.Modified = modifiedNow()
+		created[i] = m
+		docs[i] = mongoMember{Member: m, Terms: memberTerms(m)}
+	}
+
+	opts := options.InsertMany().SetOrdered(false)
+	var err error
+	if atomic {
+		var session mongo.Session
+		session, err = s.collection.Database().Client().StartSession()
+		if err != nil {
+			return nil, nil, err
+		}
+		defer session.EndSession(ctx)
+		_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+			return s.collection.InsertMany(sc, docs, opts)
+		})
+	} else {
+		_, err = s.collection.InsertMany(ctx, docs, opts)
+	}
+
+	errs := make([]error, len(members))
+	var bulk mongo.BulkWriteException
+	if !errors.As(err, &bulk) {
+		if err != nil {
+			return nil, nil, err
+		}
+		return created, errs, nil
+	}
+	if bulk.WriteConcernError != nil {
+		return nil, nil, err
+	}
+	for _, writeErr := range bulk.WriteErrors {
+		if !mongo.IsDuplicateKeyError(writeErr) {
+			return nil, nil, err
+		}
+		errs[writeErr.Index] = errDuplicateID
+		created[writeErr.Index] = Member{}
+	}
+	if atomic {
+		// The transaction was aborted, so nothing was saved
+		return make([]Member, len(members)), errs, nil
+	}
+	return created, errs, nil
+}
+
+// How many times Modify reads the member again after losing a race with another write
+const maxModifyAttempts = 5
+
+// Read, change and save a member. The write only matches the version that was read,
+// so a concurrent change makes it miss and the member is read again.
+func (s *mongoStore) Modify(ctx context.Context, clid string, fn func(Member) (Member, error)) (Member, error) {
+	for attempt := 0; attempt < maxModifyAttempts; attempt++ {
+		current, err := s.Get(ctx, clid)
+		if err != nil {
+			return Member{}, err
+		}
+
+		updated, err := fn(current)
+		if err != nil {
+			return Member{}, err
+		}
+		if unchanged(current, updated) {
+			return current, nil
+		}
+		updated.ID = clid
+		updated.Version = current.Version + 1
+		updated.Modified = modifiedNow()
+
+		set := bson.D{
+			{Key: "version", Value: updated.Version},
+			{Key: "modified", Value: updated.Modified},
+			{Key: "terms", Value: memberTerms(updated)},
+		}
+		result, err := s.collection.UpdateOne(ctx, versionFilter(clid, current.Version), fieldsUpdate(set, allFields(updated)))
+		if err != nil {
+			return Member{}, err
+		}
+		if result.MatchedCount == 1 {
+			return updated, nil
+		}
+	}
+	return Member{}, errWriteConflict
+}
+
+// Match a member by ID and version. Documents saved before members had versions read as version 0.
+func versionFilter(clid string, version int64) bson.D {
+	if version == 0 {
+		return bson.D{{Key: "clid", Value: clid}, {Key: "version", Value: bson.D{{Key: "$in", Value: bson.A{0, nil}}}}}
+	}
+	return bson.D{{Key: "clid", Value: clid}, {Key: "version", Value: version}}
+}
+
+// Delete the member with a matching ID and version
+func (s *mongoStore) Delete(ctx context.Context, clid string, version int64) error {
+	filter := clidFilter(clid)
+	if version != 0 {
+		filter = versionFilter(clid, version)
+	}
+	result, err := s.collection.DeleteOne(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 1 {
+		return nil
+	}
+
+	// Tell a missing member from one with another version
+	if version != 0 {
+		if _, err := s.Get(ctx, clid); err == nil {
+			return errVersionMismatch
+		}
+	}
+	return errMemberNotFound
+}
+
+// Delete every member that passes the filters
+func (s *mongoStore) DeleteMatching(ctx context.Context, q memberQuery) (int, error) {
+	result, err := s.collection.DeleteMany(ctx, queryFilter(q.filters()))
+	if err != nil {
+		return 0, err
+	}
+	return int(result.DeletedCount), nil
+}
+
+// Delete every member in the collection
+func (s *mongoStore) DeleteAll(ctx context.Context) error {
+	_, err := s.collection.DeleteMany(ctx, bson.D{})
+	return err
+}
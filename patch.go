@@ -0,0 +1,437 @@
+/*
+	patch.go
+		Provides the patch document formats accepted by PATCH /api/members/{id}
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Content types of the patch formats
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+// A patch that could not be applied, with the status it should be reported as:
+// 400 when the patch itself is malformed, 409 when it does not fit the stored member
+type patchError struct {
+	status  int
+	message string
+}
+
+func (e *patchError) Error() string {
+	return e.message
+}
+
+// A malformed patch
+func badPatch(format string, args ...interface{}) error {
+	return &patchError{status: http.StatusBadRequest, message: fmt.Sprintf(format, args...)}
+}
+
+// A patch that does not apply to the stored member
+func conflictingPatch(format string, args ...interface{}) error {
+	return &patchError{status: http.StatusConflict, message: fmt.Sprintf(format, args...)}
+}
+
+// Apply an RFC 7386 merge patch: objects are merged key by key, null removes a key,
+// and any other value replaces the target outright
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+			continue
+		}
+		targetObject[key] = mergePatch(targetObject[key], value)
+	}
+	return targetObject
+}
+
+// Apply a merge patch document to a member, returning the merged member.
+// The ID cannot be changed by a patch.
+func mergePatchMember(m Member, patchDoc []byte) (Member, error) {
+	var patch interface{}
+	if err := json.Unmarshal(patchDoc, &patch); err != nil {
+		return m, badPatch("The merge patch is not valid JSON: %v", err)
+	}
+	if _, ok := patch.(map[string]interface{}); !ok {
+		return m, badPatch("The merge patch must be a JSON object")
+	}
+
+	merged, err := applyToMember(m, func(doc interface{}) (interface{}, error) {
+		return mergePatch(doc, patch), nil
+	})
+	if err != nil {
+		return m, err
+	}
+	if merged.ID != m.ID {
+		return m, badPatch("The member ID cannot be changed")
+	}
+	return merged, nil
+}
+
+// A single RFC 6902 operation
+type patchOperation struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	From string `json:"from"`
+	// The JSON of the value as sent, so null can be told apart from no value at all
+	Value json.RawMessage `json:"value"`
+}
+
+// Apply an RFC 6902 JSON Patch document to a member. Either every operation applies or none do.
+// Tags that are null are treated as an empty list, so "/tags/-" always appends.
+func jsonPatchMember(m Member, patchDoc []byte) (Member, error) {
+	var ops []patchOperation
+	if err := json.Unmarshal(patchDoc, &ops); err != nil {
+		return m, badPatch("The JSON patch must be an array of operations: %v", err)
+	}
+
+	patched, err := applyToMember(m, func(doc interface{}) (interface{}, error) {
+		if object, ok := doc.(map[string]interface{}); ok && object["tags"] == nil {
+			object["tags"] = []interface{}{}
+		}
+		for i, op := range ops {
+			var err error
+			doc, err = applyOperation(doc, op)
+			if err != nil {
+				if pe, ok := err.(*patchError); ok {
+					pe.message = fmt.Sprintf("Operation %d (%s %s): %s", i, op.Op, op.Path, pe.message)
+				}
+				return nil, err
+			}
+		}
+		return doc, nil
+	})
+	if err != nil {
+		return m, err
+	}
+	if patched.ID != m.ID {
+		return m, badPatch("The member ID cannot be changed")
+	}
+	return patched, nil
+}
+
+// Apply one operation to a JSON document
+func applyOperation(doc interface{}, op patchOperation) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	switch op.Op {
+	case "add", "replace", "test":
+		if len(op.Value) == 0 {
+			return nil, badPatch("the operation needs a value")
+		}
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			return nil, badPatch("the value is not valid JSON")
+		}
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		// A value cannot go inside itself: moving would lose it, and copying would make a cycle
+		if insidePointer(path, from) {
+			return nil, badPatch("the value at %q cannot be put inside itself", op.From)
+		}
+		if value, err = getPointer(doc, from); err != nil {
+			return nil, err
+		}
+		if op.Op == "copy" {
+			// The copy must not share objects or arrays with the original, or later operations would change both
+			value = deepCopy(value)
+		}
+		if op.Op == "move" {
+			if doc, err = removePointer(doc, from); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	switch op.Op {
+	case "add", "move", "copy":
+		return addPointer(doc, path, value)
+	case "remove":
+		return removePointer(doc, path)
+	case "replace":
+		// Replacing the root replaces the whole member
+		if len(path) == 0 {
+			return value, nil
+		}
+		if doc, err = removePointer(doc, path); err != nil {
+			return nil, err
+		}
+		return addPointer(doc, path, value)
+	case "test":
+		current, err := getPointer(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, conflictingPatch("the test failed")
+		}
+		return doc, nil
+	}
+	return nil, badPatch("unknown operation %q", op.Op)
+}
+
+// Whether a pointer refers to a value inside the one another pointer refers to
+func insidePointer(path []string, parent []string) bool {
+	if len(path) <= len(parent) {
+		return false
+	}
+	for i := range parent {
+		if path[i] != parent[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Copy a decoded JSON value, including the objects and arrays inside it
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			copied[key] = deepCopy(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = deepCopy(item)
+		}
+		return copied
+	}
+	return value
+}
+
+// Split an RFC 6901 JSON Pointer into its unescaped tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, badPatch("the path %q must start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// Parse an array index. "-" means the end of the array, and is only allowed when adding.
+func arrayIndex(token string, length int, adding bool) (int, error) {
+	if token == "-" && adding {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || strings.HasPrefix(token, "+") || (len(token) > 1 && token[0] == '0') {
+		return 0, badPatch("%q is not an array index", token)
+	}
+	if i > length || (i == length && !adding) {
+		return 0, conflictingPatch("index %d is out of range", i)
+	}
+	return i, nil
+}
+
+// Read the value a pointer refers to
+func getPointer(doc interface{}, path []string) (interface{}, error) {
+	current := doc
+	for _, token := range path {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, conflictingPatch("%q does not exist", token)
+			}
+			current = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			current = node[i]
+		default:
+			return nil, conflictingPatch("%q does not exist", token)
+		}
+	}
+	return current, nil
+}
+
+// Add a value at a pointer, inserting into arrays and setting object members
+func addPointer(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := getPointer(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+		return doc, nil
+	case []interface{}:
+		i, err := arrayIndex(last, len(node), true)
+		if err != nil {
+			return nil, err
+		}
+		node = append(node, nil)
+		copy(node[i+1:], node[i:])
+		node[i] = value
+		return setPointer(doc, path[:len(path)-1], node)
+	}
+	return nil, conflictingPatch("%q cannot contain values", strings.Join(path[:len(path)-1], "/"))
+}
+
+// Remove the value at a pointer, which must exist
+func removePointer(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, badPatch("the whole member cannot be removed")
+	}
+	parent, err := getPointer(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		if _, ok := node[last]; !ok {
+			return nil, conflictingPatch("%q does not exist", last)
+		}
+		delete(node, last)
+		return doc, nil
+	case []interface{}:
+		i, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		node = append(node[:i], node[i+1:]...)
+		return setPointer(doc, path[:len(path)-1], node)
+	}
+	return nil, conflictingPatch("%q does not exist", last)
+}
+
+// Store a resized array back into its parent
+func setPointer(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := getPointer(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+	case []interface{}:
+		i, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = value
+	}
+	return doc, nil
+}
+
+// Run fn over the JSON form of a member and decode the result back into a member
+func applyToMember(m Member, fn func(doc interface{}) (interface{}, error)) (Member, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return m, err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return m, err
+	}
+
+	doc, err = fn(doc)
+	if err != nil {
+		return m, err
+	}
+
+	data, err = json.Marshal(doc)
+	if err != nil {
+		return m, err
+	}
+	var result Member
+	if err := json.Unmarshal(data, &result); err != nil {
+		return m, badPatch("The patched member is not valid: %v", err)
+	}
+	return result, nil
+}
+
+// Every stored field of a member, for replacing it in a single write
+func allFields(m Member) map[string]interface{} {
+	return map[string]interface{}{
+		"firstname": m.FirstName,
+		"lastname":  m.LastName,
+		"jobtype":   m.JobType,
+		"role":      m.Role,
+		"duration":  m.Duration,
+		"tags":      m.Tags,
+	}
+}
+
+// The change a PATCH body makes to a member, for any of the body formats PATCH /api/members/{id} accepts.
+// A plain JSON body is read and checked once, so its mistakes are returned here rather than for each member.
+func (s *server) memberPatch(contentType string, body []byte) (func(Member) (Member, error), error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case mergePatchType:
+		if s.rejectUnknownFields {
+			if err := unknownFields(body); err != nil {
+				return nil, err
+			}
+		}
+		return func(m Member) (Member, error) { return mergePatchMember(m, body) }, nil
+	case jsonPatchType:
+		if s.rejectUnknownFields {
+			if err := unknownPatchFields(body); err != nil {
+				return nil, err
+			}
+		}
+		return func(m Member) (Member, error) { return jsonPatchMember(m, body) }, nil
+	}
+
+	member, err := s.parseMember(body)
+	if err != nil {
+		return nil, err
+	}
+	if errs := updateErrors(member); len(errs) > 0 {
+		return nil, validationErrors(errs)
+	}
+	fields := updateFields(member)
+	return func(m Member) (Member, error) {
+		err := setMemberFields(&m, fields)
+		return m, err
+	}, nil
+}
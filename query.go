@@ -0,0 +1,364 @@
+/*
+	query.go
+		Provides the filters, sort order, pages and field selection for GET /api/members
+		and how they are read from the query string
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The largest page a client can ask for
+const maxPageLimit = 1000
+
+// Narrows the members a List returns. The zero value matches every member.
+type memberQuery struct {
+	// Compared without regard to case, like the validation rules do
+	JobType string
+	// Compared exactly
+	Role     string
+	Duration string
+	Tags     []string
+	// Whether a member needs every one of Tags, or at least one of them
+	AllTags bool
+
+	// The order of the list. It always ends with clid, so no two members are ever equal;
+	// an empty Sort means by clid alone.
+	Sort []sortKey
+	// Only members after this position are listed: the values of the Sort fields of the last member seen
+	After []string
+	// At most this many members are listed, or all of them for 0
+	Limit int
+
+	// The fields the client wants, or nil for all of them. Stores may skip reading the others.
+	Fields []string
+}
+
+// A field to sort by, and whether in descending order
+type sortKey struct {
+	Field string
+	Desc  bool
+}
+
+// The fields a list can be sorted by. Every one is a string, so a cursor can hold its value.
+var sortableFields = []string{"clid", "firstname", "lastname", "jobtype", "role", "duration"}
+
+// The fields a client can ask for
+var projectableFields = []string{"clid", "firstname", "lastname", "jobtype", "role", "duration", "tags", "version"}
+
+// The value of a sortable field of a member
+func sortValue(m Member, field string) string {
+	switch field {
+	case "firstname":
+		return m.FirstName
+	case "lastname":
+		return m.LastName
+	case "jobtype":
+		return m.JobType
+	case "role":
+		return m.Role
+	case "duration":
+		return m.Duration
+	}
+	return m.ID
+}
+
+// The sort keys, with the clid tie-breaker added when it is missing
+func (q memberQuery) sortKeys() []sortKey {
+	for _, k := range q.Sort {
+		if k.Field == "clid" {
+			return q.Sort
+		}
+	}
+	return append(append([]sortKey{}, q.Sort...), sortKey{Field: "clid"})
+}
+
+// Compare a member with a position in the sort order: negative if it comes first, positive if after
+func comparePosition(m Member, keys []sortKey, position []string) int {
+	for i, k := range keys {
+		c := strings.Compare(sortValue(m, k.Field), position[i])
+		if k.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// The position of a member in the sort order, as stored in a cursor
+func sortPosition(m Member, keys []sortKey) []string {
+	position := make([]string, len(keys))
+	for i, k := range keys {
+		position[i] = sortValue(m, k.Field)
+	}
+	return position
+}
+
+// Whether the client wants a field
+func (q memberQuery) wants(field string) bool {
+	if q.Fields == nil {
+		return true
+	}
+	for _, f := range q.Fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a member passes the filters. The stores that cannot filter in a query use this.
+func (q memberQuery) matches(m Member) bool {
+	if q.JobType != "" && !strings.EqualFold(m.JobType, q.JobType) {
+		return false
+	}
+	if q.Role != "" && m.Role != q.Role {
+		return false
+	}
+	if q.Duration != "" && m.Duration != q.Duration {
+		return false
+	}
+	if len(q.Tags) == 0 {
+		return true
+	}
+
+	found := 0
+	for _, want := range q.Tags {
+		for _, tag := range m.Tags {
+			if tag == want {
+				found++
+				break
+			}
+		}
+	}
+	if q.AllTags {
+		return found == len(q.Tags)
+	}
+	return found > 0
+}
+
+// Only the filters of the query, without its sort order, page or fields
+func (q memberQuery) filters() memberQuery {
+	return memberQuery{JobType: q.JobType, Role: q.Role, Duration: q.Duration, Tags: q.Tags, AllTags: q.AllTags}
+}
+
+// Whether any filter is set
+func (q memberQuery) filtered() bool {
+	return q.JobType != "" || q.Role != "" || q.Duration != "" || len(q.Tags) > 0
+}
+
+// Read the filters, sort order, page and fields from a query string such as
+// ?jobtype=contractor&tag=go&tag=remote&tag_match=any&sort=lastname,-firstname&limit=50&fields=clid,lastname.
+// Tags are matched with all of them by default.
+func parseMemberQuery(values url.Values) (memberQuery, error) {
+	q := memberQuery{
+		JobType:  values.Get("jobtype"),
+		Role:     values.Get("role"),
+		Duration: values.Get("duration"),
+		AllTags:  true,
+	}
+	for _, tag := range values["tag"] {
+		if tag != "" {
+			q.Tags = append(q.Tags, tag)
+		}
+	}
+
+	switch values.Get("tag_match") {
+	case "", "all":
+	case "any":
+		q.AllTags = false
+	default:
+		return q, fmt.Errorf("The tag_match parameter must be either 'any' or 'all'")
+	}
+
+	if sort := values.Get("sort"); sort != "" {
+		keys, err := parseSort(sort)
+		if err != nil {
+			return q, err
+		}
+		q.Sort = keys
+	}
+	q.Sort = q.sortKeys()
+
+	if fields := values.Get("fields"); fields != "" {
+		projection, err := parseFields(fields)
+		if err != nil {
+			return q, err
+		}
+		q.Fields = projection
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return q, fmt.Errorf("The limit parameter must be a number from 1 to %d", maxPageLimit)
+		}
+		q.Limit = n
+	}
+	if cursor := values.Get("cursor"); cursor != "" {
+		after, err := decodeCursor(cursor, q.Sort)
+		if err != nil {
+			return q, fmt.Errorf("The cursor parameter is not valid for this sort order. Use the next link of the previous page as is")
+		}
+		q.After = after
+	}
+	return q, nil
+}
+
+// The query parameters a bulk update or delete understands. Anything else, such as a misspelled filter, is refused.
+var filterParams = []string{"jobtype", "role", "duration", "tag", "tag_match"}
+var bulkFlags = []string{"dry_run", "all"}
+
+// Read only the filters of a bulk update or delete from a query string such as ?tag=alumni&dry_run=true.
+// A change to many members must not widen by mistake, so an unknown parameter, an empty filter
+// or a flag other than true or false is an error rather than being ignored.
+func parseBulkFilter(values url.Values) (memberQuery, error) {
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch {
+		case contains(filterParams, name):
+			for _, value := range values[name] {
+				if strings.TrimSpace(value) == "" {
+					return memberQuery{}, fmt.Errorf("The %s parameter must not be empty", name)
+				}
+			}
+		case contains(bulkFlags, name):
+			if value := values.Get(name); value != "true" && value != "false" {
+				return memberQuery{}, fmt.Errorf("The %s parameter must be either 'true' or 'false'", name)
+			}
+		default:
+			return memberQuery{}, fmt.Errorf("Unknown parameter %q. The members to change can be chosen by %s", name, strings.Join(filterParams, ", "))
+		}
+	}
+
+	q, err := parseMemberQuery(url.Values{
+		"jobtype": values["jobtype"], "role": values["role"], "duration": values["duration"],
+		"tag": values["tag"], "tag_match": values["tag_match"],
+	})
+	return q.filters(), err
+}
+
+// Read a sort order such as lastname,-firstname. A minus sign sorts that field in descending order.
+func parseSort(sort string) ([]sortKey, error) {
+	var keys []sortKey
+	seen := map[string]bool{}
+	for _, part := range strings.Split(sort, ",") {
+		key := sortKey{Field: strings.TrimSpace(part)}
+		if strings.HasPrefix(key.Field, "-") {
+			key.Field, key.Desc = key.Field[1:], true
+		}
+		if !contains(sortableFields, key.Field) {
+			return nil, fmt.Errorf("The list cannot be sorted by %q. Please sort by %s", key.Field, strings.Join(sortableFields, ", "))
+		}
+		if seen[key.Field] {
+			return nil, fmt.Errorf("The list cannot be sorted by %q twice", key.Field)
+		}
+		seen[key.Field] = true
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Read a list of fields such as clid,firstname,tags
+func parseFields(fields string) ([]string, error) {
+	var projection []string
+	for _, field := range strings.Split(fields, ",") {
+		field = strings.TrimSpace(field)
+		if !contains(projectableFields, field) {
+			return nil, fmt.Errorf("There is no member field %q. Please choose from %s", field, strings.Join(projectableFields, ", "))
+		}
+		if !contains(projection, field) {
+			projection = append(projection, field)
+		}
+	}
+	return projection, nil
+}
+
+// Whether a list holds a value
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Only the requested fields of a member, for a response with ?fields=
+func projectMember(m Member, fields []string) map[string]interface{} {
+	var all map[string]interface{}
+	data, _ := json.Marshal(sentMember(m))
+	json.Unmarshal(data, &all)
+
+	projected := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		if value, ok := all[field]; ok {
+			projected[field] = value
+		}
+	}
+	return projected
+}
+
+// Where the next page starts: the sort order it was made for and the position of the last member.
+// Clients treat it as opaque, so its contents can change between versions.
+type pageCursor struct {
+	Sort  string   `json:"sort"`
+	After []string `json:"after"`
+}
+
+// The sort order as it appears in a cursor, such as lastname,-firstname,clid
+func sortString(keys []sortKey) string {
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k.Field
+		if k.Desc {
+			parts[i] = "-" + k.Field
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// Encode the position after the last member of a page
+func encodeCursor(last Member, keys []sortKey) string {
+	data, _ := json.Marshal(pageCursor{Sort: sortString(keys), After: sortPosition(last, keys)})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Decode a cursor made by encodeCursor for the same sort order
+func decodeCursor(cursor string, keys []sortKey) ([]string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	var c pageCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	if c.Sort != sortString(keys) || len(c.After) != len(keys) {
+		return nil, fmt.Errorf("the cursor was made for another sort order")
+	}
+	return c.After, nil
+}
+
+// The URL of the page after the provided last member, keeping every other parameter of the request
+func nextPageURL(u *url.URL, last Member, keys []sortKey) string {
+	values := u.Query()
+	values.Set("cursor", encodeCursor(last, keys))
+	next := *u
+	next.RawQuery = values.Encode()
+	return next.RequestURI()
+}
@@ -0,0 +1,173 @@
+/*
+	request.go
+		Provides the strict reading of request bodies: a size limit, a 400 for anything that is
+		not a JSON member, and the optional refusal of fields a member does not have
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// The largest request body the API reads. A larger one is refused with 413.
+const maxBodyBytes = 1 << 20
+
+// The JSON names of the fields a member body can hold. The version is read-only and ignored.
+var memberFieldNames = []string{"clid", "firstname", "lastname", "jobtype", "role", "duration", "tags", "version"}
+
+// A request body that could not be read, with the status to answer it with
+type bodyError struct {
+	status  int
+	message string
+	// The unknown fields, when those are why the body was refused
+	fields []fieldError
+}
+
+func (e *bodyError) Error() string {
+	return e.message
+}
+
+// Read the whole request body, refusing one larger than maxBodyBytes
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	return readBodyLimit(w, r, maxBodyBytes)
+}
+
+// Read the whole request body, refusing one larger than limit
+func readBodyLimit(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, &bodyError{status: http.StatusRequestEntityTooLarge, message: fmt.Sprintf("The request body must not be larger than %d bytes", limit)}
+	}
+	if err != nil {
+		return nil, &bodyError{status: http.StatusBadRequest, message: "The request body could not be read"}
+	}
+	return data, nil
+}
+
+// Read a member from the request body. Malformed JSON and values of the wrong type are refused,
+// and so are fields a member does not have when the server is set to reject them.
+func (s *server) decodeMember(w http.ResponseWriter, r *http.Request) (Member, error) {
+	data, err := readBody(w, r)
+	if err != nil {
+		return Member{}, err
+	}
+	return s.parseMember(data)
+}
+
+// Read a member from JSON, as decodeMember does for a whole request body
+func (s *server) parseMember(data []byte) (Member, error) {
+	var member Member
+	if len(bytes.TrimSpace(data)) == 0 {
+		return member, &bodyError{status: http.StatusBadRequest, message: "The request body is empty. Please send the member as a JSON object"}
+	}
+	if err := json.Unmarshal(data, &member); err != nil {
+		return member, jsonError(err)
+	}
+	if s.rejectUnknownFields {
+		if err := unknownFields(data); err != nil {
+			return member, err
+		}
+	}
+	return member, nil
+}
+
+// Explain why a body could not be decoded into a member
+func jsonError(err error) error {
+	var syntax *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntax):
+		return &bodyError{status: http.StatusBadRequest, message: fmt.Sprintf("The request body is not valid JSON: %v (at byte %d)", err, syntax.Offset)}
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return &bodyError{status: http.StatusBadRequest, message: fmt.Sprintf("The field %s must be %s, but the request has a JSON %s", typeErr.Field, jsonTypeName(typeErr.Type.String()), typeErr.Value)}
+	case errors.As(err, &typeErr):
+		return &bodyError{status: http.StatusBadRequest, message: "The request body must be a JSON object"}
+	}
+	return &bodyError{status: http.StatusBadRequest, message: "The request body is not valid JSON: " + err.Error()}
+}
+
+// How a Go type of a member field is called in JSON
+func jsonTypeName(goType string) string {
+	switch goType {
+	case "string":
+		return "a string"
+	case "[]string":
+		return "an array of strings"
+	case "int64":
+		return "a number"
+	}
+	return goType
+}
+
+// Refuse a JSON object with fields a member does not have, naming every one of them
+func unknownFields(data []byte) error {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		return jsonError(err)
+	}
+
+	var unknown []string
+	for key := range object {
+		if !contains(memberFieldNames, key) {
+			unknown = append(unknown, key)
+		}
+	}
+	return unknownFieldsError(unknown)
+}
+
+// Refuse a JSON patch whose operations reach fields a member does not have, judged by the first
+// segment of each path. An operation on the whole member has its value checked like a body.
+func unknownPatchFields(patchDoc []byte) error {
+	var ops []patchOperation
+	if err := json.Unmarshal(patchDoc, &ops); err != nil {
+		// jsonPatchMember explains a malformed patch
+		return nil
+	}
+
+	var unknown []string
+	for _, op := range ops {
+		path, err := parsePointer(op.Path)
+		if err != nil {
+			return nil
+		}
+		if len(path) == 0 {
+			if len(op.Value) > 0 {
+				if err := unknownFields(op.Value); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if !contains(memberFieldNames, path[0]) {
+			unknown = append(unknown, path[0])
+		}
+	}
+	return unknownFieldsError(distinct(unknown))
+}
+
+// The error for a request with fields a member does not have, naming every one of them, or nil when there are none
+func unknownFieldsError(unknown []string) error {
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+
+	errs := make([]fieldError, len(unknown))
+	for i, key := range unknown {
+		errs[i] = fieldError{Field: key, Rule: "unknown", Message: fmt.Sprintf("A member has no field %q", key)}
+	}
+	return &bodyError{
+		status:  http.StatusBadRequest,
+		message: "The request has fields a member does not have: " + strings.Join(unknown, ", "),
+		fields:  errs,
+	}
+}
@@ -0,0 +1,179 @@
+/*
+	response.go
+		Provides the JSON bodies the member routes answer with, and the legacy text responses
+		a client can still ask for with its Accept header.
+
+		Errors are always problem+json, see errorFuncs.go.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The body of a list of members
+type memberList struct {
+	// The members, or only their requested fields. Never null, so an empty list is []
+	Items interface{} `json:"items"`
+	// How many items this response holds
+	Count int `json:"count"`
+	// The URL of the next page, the same as the Link header, when there is one
+	Next string `json:"next,omitempty"`
+	// Whether a search matched too many members to rank them all
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// The body of a newly created member: the member as it was stored, and a warning when it
+// was stored under another ID than the one requested
+type createdMember struct {
+	Member
+	Warning string `json:"warning,omitempty"`
+}
+
+// The body of a request that changed the members without sending one back
+type actionResult struct {
+	Message string `json:"message"`
+	// The member the request was about, if it was about one
+	ID string `json:"clid,omitempty"`
+}
+
+// The body of a request that updated or deleted every member passing its filters
+type bulkResult struct {
+	Message string `json:"message"`
+	// How many members passed the filters, how many were changed and how many could not be
+	Matched int `json:"matched"`
+	Changed int `json:"changed"`
+	Failed  int `json:"failed"`
+	// Whether the request only reported what it would do
+	DryRun bool `json:"dry_run"`
+	// Why each failed member could not be changed
+	Items []batchResult `json:"items,omitempty"`
+}
+
+// A number of members, such as "1 member" or "3 members"
+func countMembers(n int) string {
+	if n == 1 {
+		return "1 member"
+	}
+	return strconv.Itoa(n) + " members"
+}
+
+// Write a JSON body with the provided status
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// A member as sent to clients. A member without tags always has "tags":[], however the request or the store left them.
+func sentMember(m Member) Member {
+	if m.Tags == nil {
+		m.Tags = []string{}
+	}
+	return m
+}
+
+// The URL of a member, as sent in the Location header
+func memberLocation(clid string) string {
+	return "/api/members/" + url.PathEscape(clid)
+}
+
+// Write one of the plain messages the API used to answer with, as the text/plain the client asked for
+func writeLegacyText(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprint(w, message)
+}
+
+// Send the result of a change as JSON, or only its message to a legacy client
+func writeResult(w http.ResponseWriter, r *http.Request, result actionResult) {
+	if legacyText(w, r) {
+		writeLegacyText(w, http.StatusOK, result.Message)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// Send the result of a bulk change as JSON, or only its message to a legacy client
+func writeBulkResult(w http.ResponseWriter, r *http.Request, result bulkResult) {
+	if legacyText(w, r) {
+		writeLegacyText(w, http.StatusOK, result.Message)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// Whether to send the legacy text response, noting that the response depends on the Accept header
+// so caches keep the JSON and text versions apart
+func legacyText(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Add("Vary", "Accept")
+	return wantsLegacyText(r)
+}
+
+// Whether the client asked for the legacy text responses: its Accept header names text/plain itself,
+// not only through text/* or */*, and prefers it to application/json. Browsers ask for text/html and */*,
+// so like clients without an Accept header they get JSON.
+func wantsLegacyText(r *http.Request) bool {
+	header := r.Header.Get("Accept")
+	if header == "" {
+		return false
+	}
+	text, specificity := acceptMatch(header, "text/plain")
+	return specificity == exactMatch && text > acceptQuality(header, "application/json")
+}
+
+// How specifically an Accept range matches a media type: exactly, as type/*, or as */*
+const (
+	anyMatch = iota
+	typeMatch
+	exactMatch
+)
+
+// The quality an Accept header gives a media type, from its most specific matching range.
+// A type that no range matches has quality 0.
+func acceptQuality(header string, mediaType string) float64 {
+	quality, _ := acceptMatch(header, mediaType)
+	return quality
+}
+
+// The quality an Accept header gives a media type and how specific the range it came from is.
+// A type that no range matches has quality 0 and specificity -1.
+func acceptMatch(header string, mediaType string) (float64, int) {
+	quality, specificity := 0.0, -1
+	for _, part := range strings.Split(header, ",") {
+		accepted, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		// Exact types beat type/* ranges, which beat */*
+		match := -1
+		switch {
+		case accepted == mediaType:
+			match = exactMatch
+		case strings.HasSuffix(accepted, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(accepted, "*")):
+			match = typeMatch
+		case accepted == "*/*":
+			match = anyMatch
+		}
+		if match <= specificity {
+			continue
+		}
+
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		quality, specificity = q, match
+	}
+	return quality, specificity
+}
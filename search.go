@@ -0,0 +1,157 @@
+/*
+	search.go
+		Provides the words members can be found by and the relevance order of search results
+		for GET /api/members/search.
+
+		Every store keeps an index from each word to the members that have it. A search word
+		matches any indexed word it is the start of, so "ann" finds Ann and Annabel.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The number of results a search returns without a limit, and the most a client can ask for
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// The most words a search can have, so one request cannot ask the index for everything at once
+const maxSearchWords = 10
+
+// The fewest letters a search word needs, since a single letter is the start of too many words. Shorter words are left out.
+const minSearchWordLength = 2
+
+// The most members a store ranks for one search, the first ones by clid. A search that matches more
+// ranks only those and says it was truncated, so a client knows to add words to narrow it down.
+const maxSearchCandidates = 1000
+
+// A searchable field of a member and how much a match in it counts
+type searchField struct {
+	text   string
+	weight float64
+}
+
+// The fields a search looks at. A match in a name counts most, then the role, then a tag.
+func searchFields(m Member) []searchField {
+	return []searchField{
+		{m.FirstName, 3},
+		{m.LastName, 3},
+		{m.Role, 2},
+		{strings.Join(m.Tags, " "), 1},
+	}
+}
+
+// The words of a text in lower case. Anything but a letter or a digit separates words.
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Every word a member can be found by, without repeats. This is what the stores index.
+func memberTerms(m Member) []string {
+	var terms []string
+	for _, field := range searchFields(m) {
+		terms = append(terms, searchWords(field.text)...)
+	}
+	return distinct(terms)
+}
+
+// How relevant a member is to the search words, or 0 when a word matches nothing.
+// Each word counts the weight of the field it matches best: fully for the whole word, half for its start.
+func searchScore(m Member, words []string) float64 {
+	fields := searchFields(m)
+	total := 0.0
+	for _, word := range words {
+		best := 0.0
+		for _, field := range fields {
+			for _, term := range searchWords(field.text) {
+				score := 0.0
+				if term == word {
+					score = field.weight
+				} else if strings.HasPrefix(term, word) {
+					score = field.weight / 2
+				}
+				if score > best {
+					best = score
+				}
+			}
+		}
+		if best == 0 {
+			return 0
+		}
+		total += best
+	}
+	return total
+}
+
+// Put the members found by a search in relevance order, most relevant first, and keep at most limit of them.
+// Members that are equally relevant are sorted by clid.
+func rankMembers(members []Member, words []string, limit int) []Member {
+	scores := make(map[string]float64, len(members))
+	var ranked []Member
+	for _, m := range members {
+		if score := searchScore(m, words); score > 0 {
+			scores[m.ID] = score
+			ranked = append(ranked, m)
+		}
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if scores[a.ID] != scores[b.ID] {
+			return scores[a.ID] > scores[b.ID]
+		}
+		return a.ID < b.ID
+	})
+	if limit > 0 && len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	return ranked
+}
+
+// Rank the members a store found, in clid order. A store reads one more than maxSearchCandidates,
+// so finding more than that means the search was truncated and only the first ones are ranked.
+func rankCandidates(members []Member, words []string, limit int) ([]Member, bool) {
+	truncated := len(members) > maxSearchCandidates
+	if truncated {
+		members = members[:maxSearchCandidates]
+	}
+	return rankMembers(members, words, limit), truncated
+}
+
+// Read the search words and limit from a query string such as ?q=ann+lead&limit=10
+func parseSearch(values url.Values) ([]string, int, error) {
+	// Words too short to search by, such as the o of O'Brien, are left out
+	var words []string
+	for _, word := range distinct(searchWords(values.Get("q"))) {
+		if len([]rune(word)) >= minSearchWordLength {
+			words = append(words, word)
+		}
+	}
+	if len(words) == 0 {
+		return nil, 0, fmt.Errorf("Please provide the words to search for in the q parameter, such as ?q=ann. Each word needs at least %d letters or digits", minSearchWordLength)
+	}
+	if len(words) > maxSearchWords {
+		return nil, 0, fmt.Errorf("A search can have at most %d words", maxSearchWords)
+	}
+
+	limit := defaultSearchLimit
+	if value := values.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			return nil, 0, fmt.Errorf("The limit parameter must be a number from 1 to %d", maxSearchLimit)
+		}
+		limit = n
+	}
+	return words, limit, nil
+}
@@ -0,0 +1,696 @@
+/*
+	sqlStore.go
+		Provides a SQL implementation of MemberStore.
+		The queries are portable between SQLite and PostgreSQL, and both drivers are built into the program.
+*/
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
+
+// Schema migrations, applied in file name order when the store is opened
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Stores members in a "members" table, their tags in a "member_tags" join table
+// and the words they can be searched by in a "member_terms" table
+type sqlStore struct {
+	db *sql.DB
+	// "sqlite" or "postgres"; decides the placeholder style
+	dialect string
+}
+
+// Open a SQLite database at the provided path and bring its schema up to date
+func openSQLiteStore(ctx context.Context, path string) (*sqlStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer, and every connection to ":memory:" would be a new database
+	db.SetMaxOpenConns(1)
+	return newSQLStore(ctx, db, "sqlite")
+}
+
+// Connect to the PostgreSQL database at the provided URL and bring its schema up to date.
+// The store uses many connections; Modify and Delete lock the rows they change.
+func openPostgresStore(ctx context.Context, url string) (*sqlStore, error) {
+	db, err := sql.Open("pgx", url)
+	if err != nil {
+		return nil, err
+	}
+	return newSQLStore(ctx, db, "postgres")
+}
+
+// Apply the migrations to an opened database and index the members that have no search words yet
+func newSQLStore(ctx context.Context, db *sql.DB, dialect string) (*sqlStore, error) {
+	s := &sqlStore{db: db, dialect: dialect}
+	if err := s.migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := s.indexTerms(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Index the words of members that have none in member_terms yet, such as those saved before search existed.
+// Every member has a first name, so an indexed member always has at least one word.
+func (s *sqlStore) indexTerms(ctx context.Context) error {
+	rows, err := s.db.QueryContext(ctx, `SELECT clid FROM members WHERE clid NOT IN (SELECT clid FROM member_terms)`)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var clid string
+		if err := rows.Scan(&clid); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, clid)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, clid := range ids {
+		err := s.inTx(ctx, func(tx *sql.Tx) error {
+			m, err := s.get(ctx, tx, clid)
+			if err != nil {
+				return err
+			}
+			return s.saveTerms(ctx, tx, m)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rewrite ? placeholders as $1, $2, ... for PostgreSQL
+func (s *sqlStore) rebind(query string) string {
+	if s.dialect != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// A column to sort or page by. PostgreSQL compares text by the database's locale,
+// so it is told to compare bytes like SQLite and the other stores do.
+func (s *sqlStore) sortColumn(field string) string {
+	if s.dialect != "postgres" {
+		return field
+	}
+	return field + ` COLLATE "C"`
+}
+
+// Apply every embedded migration that has not been applied yet
+func (s *sqlStore) migrate(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version TEXT PRIMARY KEY)`)
+	if err != nil {
+		return err
+	}
+
+	names, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return err
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i].Name() < names[j].Name() })
+
+	for _, entry := range names {
+		version := entry.Name()
+		var applied int
+		err := s.db.QueryRowContext(ctx, s.rebind(`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`), version).Scan(&applied)
+		if err != nil {
+			return err
+		}
+		if applied > 0 {
+			continue
+		}
+
+		script, err := migrationFiles.ReadFile("migrations/" + version)
+		if err != nil {
+			return err
+		}
+		err = s.inTx(ctx, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, string(script)); err != nil {
+				return fmt.Errorf("migration %s: %v", version, err)
+			}
+			_, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), version)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run fn in a transaction, committing only if it succeeds
+func (s *sqlStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Read the tags for a member in the order they were saved
+func (s *sqlStore) loadTags(ctx context.Context, q queryer, clid string) ([]string, error) {
+	rows, err := q.QueryContext(ctx, s.rebind(`SELECT tag FROM member_tags WHERE clid = ? ORDER BY position`), clid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// Replace the tags for a member
+func (s *sqlStore) saveTags(ctx context.Context, tx *sql.Tx, clid string, tags []string) error {
+	if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM member_tags WHERE clid = ?`), clid); err != nil {
+		return err
+	}
+	for i, tag := range tags {
+		_, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO member_tags (clid, position, tag) VALUES (?, ?, ?)`), clid, i, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replace the words a member can be searched by
+func (s *sqlStore) saveTerms(ctx context.Context, tx *sql.Tx, m Member) error {
+	if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM member_terms WHERE clid = ?`), m.ID); err != nil {
+		return err
+	}
+	for _, term := range memberTerms(m) {
+		_, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO member_terms (clid, term) VALUES (?, ?)`), m.ID, term)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+const memberColumns = `clid, firstname, lastname, jobtype, role, duration, version, modified`
+
+// Implemented by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Read the memberColumns of a row. Modified is kept as milliseconds since the epoch, and 0 means never.
+func scanMember(row scanner) (Member, error) {
+	var m Member
+	var modified int64
+	err := row.Scan(&m.ID, &m.FirstName, &m.LastName, &m.JobType, &m.Role, &m.Duration, &m.Version, &modified)
+	if modified != 0 {
+		m.Modified = time.UnixMilli(modified).UTC()
+	}
+	return m, err
+}
+
+// The stored form of a Modified time
+func modifiedMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// Get a member by ID
+func (s *sqlStore) Get(ctx context.Context, clid string) (Member, error) {
+	return s.get(ctx, s.db, clid)
+}
+
+// Read a member and its tags, inside or outside of a transaction
+func (s *sqlStore) get(ctx context.Context, q queryer, clid string) (Member, error) {
+	m, err := scanMember(q.QueryRowContext(ctx, s.rebind(`SELECT `+memberColumns+` FROM members WHERE clid = ?`), clid))
+	if err == sql.ErrNoRows {
+		return m, errMemberNotFound
+	}
+	if err != nil {
+		return m, err
+	}
+
+	m.Tags, err = s.loadTags(ctx, q, clid)
+	return m, err
+}
+
+// Get a page of the members that pass the filters
+func (s *sqlStore) List(ctx context.Context, q memberQuery) ([]Member, error) {
+	where, args := s.queryWhere(q)
+	var order []string
+	for _, k := range q.sortKeys() {
+		// The column names come from sortableFields, never from the request
+		direction := " ASC"
+		if k.Desc {
+			direction = " DESC"
+		}
+		order = append(order, s.sortColumn(k.Field)+direction)
+	}
+	query := `SELECT ` + memberColumns + ` FROM members` + where + ` ORDER BY ` + strings.Join(order, ", ")
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var members []Member
+	for rows.Next() {
+		m, err := scanMember(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Tags are read once the member rows are closed, since SQLite only has one connection
+	if !q.wants("tags") {
+		return members, nil
+	}
+	for i := range members {
+		members[i].Tags, err = s.loadTags(ctx, s.db, members[i].ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return members, nil
+}
+
+// Find the members with a word starting with each of the provided words, most relevant first.
+// The index finds the members, and rankCandidates orders them.
+func (s *sqlStore) Search(ctx context.Context, words []string, limit int) ([]Member, bool, error) {
+	var conditions []string
+	var args []interface{}
+	for _, word := range words {
+		conditions = append(conditions, `clid IN (SELECT clid FROM member_terms WHERE term LIKE ? ESCAPE '\')`)
+		args = append(args, escapeLike(word)+"%")
+	}
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT `+memberColumns+` FROM members WHERE `+strings.Join(conditions, " AND ")+` ORDER BY `+s.sortColumn("clid")+` LIMIT ?`), append(args, maxSearchCandidates+1)...)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var members []Member
+	for rows.Next() {
+		m, err := scanMember(rows)
+		if err != nil {
+			rows.Close()
+			return nil, false, err
+		}
+		members = append(members, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	// The tags count towards relevance, so they are read before ranking
+	for i := range members {
+		members[i].Tags, err = s.loadTags(ctx, s.db, members[i].ID)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	ranked, truncated := rankCandidates(members, words, limit)
+	return ranked, truncated, nil
+}
+
+// Escape the characters LIKE treats as wildcards
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// Translate the filters into a WHERE clause and its arguments. No filters gives an empty clause.
+func (s *sqlStore) queryWhere(q memberQuery) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	if q.JobType != "" {
+		conditions = append(conditions, "LOWER(jobtype) = LOWER(?)")
+		args = append(args, q.JobType)
+	}
+	if q.Role != "" {
+		conditions = append(conditions, "role = ?")
+		args = append(args, q.Role)
+	}
+	if q.Duration != "" {
+		conditions = append(conditions, "duration = ?")
+		args = append(args, q.Duration)
+	}
+	if q.After != nil {
+		// After the position: greater in the first key, or equal in the first and greater in the second, and so on
+		keys := q.sortKeys()
+		var or []string
+		for i, k := range keys {
+			var and []string
+			for j := 0; j < i; j++ {
+				and = append(and, s.sortColumn(keys[j].Field)+" = ?")
+				args = append(args, q.After[j])
+			}
+			operator := " > ?"
+			if k.Desc {
+				operator = " < ?"
+			}
+			and = append(and, s.sortColumn(k.Field)+operator)
+			args = append(args, q.After[i])
+			or = append(or, "("+strings.Join(and, " AND ")+")")
+		}
+		conditions = append(conditions, "("+strings.Join(or, " OR ")+")")
+	}
+	if len(q.Tags) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(q.Tags)), ", ")
+		if q.AllTags {
+			// Count the distinct wanted tags each member has
+			conditions = append(conditions, `(SELECT COUNT(DISTINCT tag) FROM member_tags t WHERE t.clid = members.clid AND t.tag IN (`+placeholders+`)) = ?`)
+		} else {
+			conditions = append(conditions, `clid IN (SELECT clid FROM member_tags WHERE tag IN (`+placeholders+`))`)
+		}
+		for _, tag := range q.Tags {
+			args = append(args, tag)
+		}
+		if q.AllTags {
+			args = append(args, len(distinct(q.Tags)))
+		}
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// The values of a list without repeats
+func distinct(values []string) []string {
+	seen := map[string]bool{}
+	var result []string
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// Insert a new member and its tags. The primary key refuses an ID already in use.
+func (s *sqlStore) Create(ctx context.Context, m Member) (Member, error) {
+	m.Version = 1
+	m.Modified = modifiedNow()
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		return s.insert(ctx, tx, m)
+	})
+	if err != nil {
+		return Member{}, err
+	}
+	return m, nil
+}
+
+// Insert a member row, its tags and its search words inside a transaction
+func (s *sqlStore) insert(ctx context.Context, tx *sql.Tx, m Member) error {
+	_, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO members (`+memberColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		m.ID, m.FirstName, m.LastName, m.JobType, m.Role, m.Duration, m.Version, modifiedMillis(m.Modified))
+	if isUniqueViolation(err) {
+		return errDuplicateID
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.saveTags(ctx, tx, m.ID, m.Tags); err != nil {
+		return err
+	}
+	return s.saveTerms(ctx, tx, m)
+}
+
+// Returned inside CreateMany's transaction to roll back an atomic batch with a failed member
+var errBatchFailed = errors.New("a member of the batch could not be saved")
+
+// Insert several members in one transaction. Each member is inserted under a savepoint, so a taken ID
+// only undoes that member; PostgreSQL would otherwise refuse every statement after the failed one.
+func (s *sqlStore) CreateMany(ctx context.Context, members []Member, atomic bool) ([]Member, []error, error) {
+	created := make([]Member, len(members))
+	errs := make([]error, len(members))
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		failed := false
+		for i, m := range members {
+			m.Version = 1
+			m.Modified = modifiedNow()
+			if _, err := tx.ExecContext(ctx, `SAVEPOINT batch_member`); err != nil {
+				return err
+			}
+
+			err := s.insert(ctx, tx, m)
+			if err == errDuplicateID {
+				errs[i], failed = err, true
+				if _, err := tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT batch_member`); err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `RELEASE SAVEPOINT batch_member`); err != nil {
+				return err
+			}
+			created[i] = m
+		}
+		if atomic && failed {
+			return errBatchFailed
+		}
+		return nil
+	})
+	if err == errBatchFailed {
+		return make([]Member, len(members)), errs, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return created, errs, nil
+}
+
+// Whether an error is SQLite's or PostgreSQL's report of a broken unique constraint.
+// The drivers share no error type, so their messages are checked instead.
+func isUniqueViolation(err error) bool {
+	if err == nil {
+		return false
+	}
+	message := err.Error()
+	return strings.Contains(message, "UNIQUE constraint failed") || strings.Contains(message, "duplicate key value") || strings.Contains(message, "SQLSTATE 23505")
+}
+
+// Read, change and save a member in one transaction, with its row locked
+func (s *sqlStore) Modify(ctx context.Context, clid string, fn func(Member) (Member, error)) (Member, error) {
+	var updated Member
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := s.lock(ctx, tx, clid); err != nil {
+			return err
+		}
+
+		current, err := s.get(ctx, tx, clid)
+		if err != nil {
+			return err
+		}
+		updated, err = fn(current)
+		if err != nil {
+			return err
+		}
+		if unchanged(current, updated) {
+			updated = current
+			return nil
+		}
+		updated.ID = clid
+		updated.Version = current.Version + 1
+		updated.Modified = modifiedNow()
+		return s.setFields(ctx, tx, clid, allFields(updated), updated.Modified)
+	})
+	return updated, err
+}
+
+// Lock a member's row until the transaction ends. SQLite already allows only one writer at a time.
+func (s *sqlStore) lock(ctx context.Context, tx *sql.Tx, clid string) error {
+	if s.dialect != "postgres" {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, s.rebind(`SELECT clid FROM members WHERE clid = ? FOR UPDATE`), clid)
+	return err
+}
+
+// Write the provided fields inside a transaction, raise the version, set the Modified time and index the words again.
+// Every column changes in a single UPDATE; the column names come from the switch, never from the request
+func (s *sqlStore) setFields(ctx context.Context, tx *sql.Tx, clid string, fields map[string]interface{}, modified time.Time) error {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	columns := []string{"version = version + 1", "modified = ?"}
+	args := []interface{}{modifiedMillis(modified)}
+	for key, value := range fields {
+		switch key {
+		case "firstname", "lastname", "jobtype", "role", "duration":
+			columns = append(columns, key+" = ?")
+			args = append(args, value)
+		case "tags":
+			tags, ok := value.([]string)
+			if !ok {
+				return fmt.Errorf("cannot set field %q to %v", key, value)
+			}
+			if err := s.saveTags(ctx, tx, clid, tags); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown member field %q", key)
+		}
+	}
+	query := `UPDATE members SET ` + strings.Join(columns, ", ") + ` WHERE clid = ?`
+	if _, err := tx.ExecContext(ctx, s.rebind(query), append(args, clid)...); err != nil {
+		return err
+	}
+
+	m, err := s.get(ctx, tx, clid)
+	if err != nil {
+		return err
+	}
+	return s.saveTerms(ctx, tx, m)
+}
+
+// Delete the member with a matching ID and version, and its tags
+func (s *sqlStore) Delete(ctx context.Context, clid string, version int64) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if version != 0 {
+			if err := s.lock(ctx, tx, clid); err != nil {
+				return err
+			}
+			current, err := s.get(ctx, tx, clid)
+			if err != nil {
+				return err
+			}
+			if current.Version != version {
+				return errVersionMismatch
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM member_tags WHERE clid = ?`), clid); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM member_terms WHERE clid = ?`), clid); err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM members WHERE clid = ?`), clid)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return errMemberNotFound
+		}
+		return nil
+	})
+}
+
+// Delete every member that passes the filters, with their tags and search words.
+// The tag filters read member_tags, so the matching IDs are found before anything is deleted.
+func (s *sqlStore) DeleteMatching(ctx context.Context, q memberQuery) (int, error) {
+	var ids []string
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		where, args := s.queryWhere(q.filters())
+		rows, err := tx.QueryContext(ctx, s.rebind(`SELECT clid FROM members`+where), args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var clid string
+			if err := rows.Scan(&clid); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, clid)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, clid := range ids {
+			for _, table := range []string{"member_tags", "member_terms", "members"} {
+				if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM `+table+` WHERE clid = ?`), clid); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
+
+// Delete every member, tag and search word
+func (s *sqlStore) DeleteAll(ctx context.Context) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM member_tags`); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM member_terms`); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `DELETE FROM members`)
+		return err
+	})
+}
@@ -0,0 +1,75 @@
+/*
+	store.go
+		Declares the storage interface the handlers use to reach member data
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// The clock stores read when a member changes. Tests replace it to get predictable times.
+var clock = time.Now
+
+// The time to save as a member's Modified time. Every store keeps milliseconds, like MongoDB.
+func modifiedNow() time.Time {
+	return clock().UTC().Truncate(time.Millisecond)
+}
+
+// Returned by a MemberStore when no member matches the provided ID
+var errMemberNotFound = errors.New("no member for the provided ID could be found")
+
+// Returned by Modify when the member kept changing under it and the change could not be applied
+var errWriteConflict = errors.New("the member was changed by another request, please try again")
+
+// Returned by Delete when the member has a different version than the one expected
+var errVersionMismatch = errors.New("the member has a different version than the one expected")
+
+// Returned by a MemberStore that enforces unique IDs when creating a member with an ID already in use
+var errDuplicateID = errors.New("a member with the provided ID already exists")
+
+// MemberStore is implemented by every storage backend for members.
+// The store owns each member's version and Modified time: Create saves version 1 and returns the stored
+// member, and every write that changes a member adds one to the version and sets Modified to modifiedNow,
+// whatever the caller passed in.
+// CreateMany saves several new members at once and returns them as stored, with one error per member:
+// nil for those that were saved, and errDuplicateID for an ID already in use, also by an earlier member
+// of the same call. With atomic, a single failed member means none are saved.
+// Modify reads a member, passes it to fn and saves the member fn returns, with no other write
+// to that member in between. An error from fn leaves the member unchanged and is returned as is.
+// When fn changes nothing, nothing is written and the member keeps its version and Modified time.
+// List returns the members that pass the filters in q, in the order of q.Sort, one page at a time.
+// Search returns at most limit members with a word starting with each of the provided words,
+// most relevant first as rankCandidates orders them, and whether there were too many to rank them all.
+// Delete only removes the member if it still has the provided version; version 0 removes any version.
+// DeleteMatching removes every member that passes the filters of q in one step and returns how many it removed.
+// The sort order and page of q are ignored.
+type MemberStore interface {
+	Get(ctx context.Context, clid string) (Member, error)
+	List(ctx context.Context, q memberQuery) ([]Member, error)
+	Search(ctx context.Context, words []string, limit int) ([]Member, bool, error)
+	Create(ctx context.Context, m Member) (Member, error)
+	CreateMany(ctx context.Context, members []Member, atomic bool) ([]Member, []error, error)
+	Modify(ctx context.Context, clid string, fn func(Member) (Member, error)) (Member, error)
+	Delete(ctx context.Context, clid string, version int64) error
+	DeleteMatching(ctx context.Context, q memberQuery) (int, error)
+	DeleteAll(ctx context.Context) error
+}
+
+// Whether a changed member holds the same stored fields as the current one, so there is nothing to save.
+// No tags and an empty list of tags are the same.
+func unchanged(current Member, updated Member) bool {
+	if len(current.Tags) != len(updated.Tags) {
+		return false
+	}
+	for i := range current.Tags {
+		if current.Tags[i] != updated.Tags[i] {
+			return false
+		}
+	}
+	return current.FirstName == updated.FirstName && current.LastName == updated.LastName &&
+		current.JobType == updated.JobType && current.Role == updated.Role && current.Duration == updated.Duration
+}
@@ -0,0 +1,482 @@
+/*
+	store_test.go
+
+		Runs the same checks against every MemberStore that can be created without a server.
+		Set API_TEST_POSTGRES_URL to a database the tests may empty to run them against PostgreSQL too.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Create each store under test
+func testStores(t *testing.T) map[string]MemberStore {
+	sqlStore, err := openSQLiteStore(context.Background(), ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]MemberStore{
+		"memory": newMemoryStore(),
+		"sqlite": sqlStore,
+	}
+
+	url := os.Getenv("API_TEST_POSTGRES_URL")
+	if url == "" {
+		return stores
+	}
+	postgresStore, err := openPostgresStore(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { postgresStore.db.Close() })
+	// Each test starts from an empty database
+	for _, table := range []string{"member_tags", "member_terms", "members"} {
+		if _, err := postgresStore.db.Exec(`DELETE FROM ` + table); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stores["postgres"] = postgresStore
+	return stores
+}
+
+// Create, read, update and delete a member in each store
+func TestStoreCRUD(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing the MemberStore implementations")
+
+	// Every change happens a minute after the last one
+	now := time.Date(2024, time.March, 15, 12, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return now }
+	defer func() { clock = time.Now }()
+
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		member := Member{ID: "7", FirstName: "Gaius", LastName: "Octavius", JobType: "Employee", Role: "Augustus", Tags: []string{"First", "Emperor"}}
+		member.Version, member.Modified = 1, now
+		received, err := store.Create(ctx, Member{ID: "7", FirstName: "Gaius", LastName: "Octavius", JobType: "Employee", Role: "Augustus", Tags: []string{"First", "Emperor"}, Version: 9})
+		assert.NoError(t, err, name)
+		assert.Equal(t, member, received, name)
+		_, err = store.Create(ctx, member)
+		assert.Equal(t, errDuplicateID, err, name)
+
+		received, err = store.Get(ctx, "7")
+		assert.NoError(t, err, name)
+		assert.Equal(t, member, received, name)
+
+		fields := map[string]interface{}{"jobtype": "Contractor", "role": "", "duration": "41 years", "tags": []string{"Emperor"}}
+		setFields := func(m Member) (Member, error) {
+			err := setMemberFields(&m, fields)
+			return m, err
+		}
+		now = now.Add(time.Minute)
+		member.JobType, member.Role, member.Duration, member.Tags, member.Version, member.Modified = "Contractor", "", "41 years", []string{"Emperor"}, 2, now
+		received, err = store.Modify(ctx, "7", setFields)
+		assert.NoError(t, err, name)
+		assert.Equal(t, member, received, name)
+
+		// A change that changes nothing is not saved, so the version and time stay the same
+		now = now.Add(time.Minute)
+		received, err = store.Modify(ctx, "7", setFields)
+		assert.NoError(t, err, name)
+		assert.Equal(t, member, received, name)
+		received, _ = store.Get(ctx, "7")
+		assert.Equal(t, member, received, name)
+
+		members, err := store.List(ctx, memberQuery{})
+		assert.NoError(t, err, name)
+		assert.Equal(t, []Member{member}, members, name)
+
+		now = now.Add(time.Minute)
+		member.Tags, member.Version, member.Modified = append(member.Tags, "Augustus"), 3, now
+		received, err = store.Modify(ctx, "7", func(m Member) (Member, error) {
+			m.Tags = append(m.Tags, "Augustus")
+			m.Version = 100
+			return m, nil
+		})
+		assert.NoError(t, err, name)
+		assert.Equal(t, member, received, name)
+		_, err = store.Modify(ctx, "7", func(m Member) (Member, error) {
+			m.FirstName = "Changed"
+			return m, errWriteConflict
+		})
+		assert.Equal(t, errWriteConflict, err, name)
+		received, _ = store.Get(ctx, "7")
+		assert.Equal(t, member, received, name)
+
+		_, err = store.Modify(ctx, "8", setFields)
+		assert.Equal(t, errMemberNotFound, err, name)
+		assert.Equal(t, errVersionMismatch, store.Delete(ctx, "7", 2), name)
+		assert.NoError(t, store.Delete(ctx, "7", 3), name)
+		assert.Equal(t, errMemberNotFound, store.Delete(ctx, "7", 0), name)
+		_, err = store.Get(ctx, "7")
+		ok := assert.Equal(t, errMemberNotFound, err, name)
+		if ok {
+			fmt.Println("Successfully used the " + name + " store")
+		}
+	}
+}
+
+// Filter the members of each store by job type, role, duration and tags
+func TestStoreQuery(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing filtering and sorting the MemberStore implementations")
+
+	ctx := context.Background()
+	members := []Member{
+		{ID: "1", FirstName: "Gaius", LastName: "Marius", JobType: "Employee", Role: "Consul", Tags: []string{"go", "remote"}},
+		{ID: "2", FirstName: "Lucius", LastName: "Sulla", JobType: "Contractor", Duration: "2 years", Tags: []string{"go"}},
+		{ID: "3", FirstName: "Marcus", LastName: "Crassus", JobType: "contractor", Duration: "1 year", Tags: []string{"remote"}},
+	}
+	// The IDs each query should return, in order
+	queries := []struct {
+		q    memberQuery
+		want string
+	}{
+		{memberQuery{}, "123"},
+		{memberQuery{JobType: "CONTRACTOR"}, "23"},
+		{memberQuery{Role: "Consul"}, "1"},
+		{memberQuery{Duration: "1 year"}, "3"},
+		{memberQuery{Tags: []string{"go"}, AllTags: true}, "12"},
+		{memberQuery{Tags: []string{"go", "remote"}}, "123"},
+		{memberQuery{Tags: []string{"go", "remote", "go"}, AllTags: true}, "1"},
+		{memberQuery{JobType: "contractor", Tags: []string{"go", "ruby"}}, "2"},
+		{memberQuery{Tags: []string{"ruby"}}, ""},
+		{memberQuery{JobType: "Employee", Role: "Dictator"}, ""},
+		{memberQuery{Limit: 2}, "12"},
+		{memberQuery{After: []string{"1"}, Limit: 2}, "23"},
+		{memberQuery{After: []string{"2"}, Tags: []string{"remote"}, Limit: 2}, "3"},
+		{memberQuery{After: []string{"3"}}, ""},
+		{memberQuery{Sort: []sortKey{{Field: "lastname"}}}, "312"},
+		{memberQuery{Sort: []sortKey{{Field: "lastname", Desc: true}}}, "213"},
+		{memberQuery{Sort: []sortKey{{Field: "clid", Desc: true}}, Limit: 2}, "32"},
+		{memberQuery{Sort: []sortKey{{Field: "duration"}}}, "132"},
+		{memberQuery{Sort: []sortKey{{Field: "duration", Desc: true}}}, "231"},
+		{memberQuery{Sort: []sortKey{{Field: "lastname"}}, After: []string{"Crassus", "3"}, Limit: 1}, "1"},
+		{memberQuery{Sort: []sortKey{{Field: "duration"}}, After: []string{"", "1"}}, "32"},
+		{memberQuery{Sort: []sortKey{{Field: "duration", Desc: true}}, After: []string{"1 year", "3"}}, "1"},
+		{memberQuery{Sort: []sortKey{{Field: "clid", Desc: true}}, After: []string{"2"}}, "1"},
+		{memberQuery{Fields: []string{"clid"}}, "123"},
+	}
+
+	for name, store := range testStores(t) {
+		for _, m := range members {
+			store.Create(ctx, m)
+		}
+		for _, query := range queries {
+			received, err := store.List(ctx, query.q)
+			assert.NoError(t, err, name)
+			assert.Equal(t, query.want, joinIDs(received), fmt.Sprintf("%s %+v", name, query.q))
+		}
+		fmt.Println("Successfully filtered and sorted the " + name + " store")
+	}
+}
+
+// Page through each store by role and duration, where members created and changed without one must not be skipped
+func TestStorePageEmptyFields(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing paging the MemberStore implementations by fields that can be empty")
+
+	ctx := context.Background()
+	members := []Member{
+		{ID: "1", FirstName: "Ann", LastName: "Smith", JobType: "Contractor", Duration: "6 months"},
+		{ID: "2", FirstName: "Bob", LastName: "Jones", JobType: "Employee", Role: "Engineer"},
+		{ID: "3", FirstName: "Carol", LastName: "Ng", JobType: "Employee", Role: "Lead"},
+		{ID: "4", FirstName: "Dan", LastName: "Lee", JobType: "Contractor", Duration: "1 year"},
+	}
+
+	for name, store := range testStores(t) {
+		for _, m := range members {
+			store.Create(ctx, m)
+		}
+		// Member 3 loses its role through a change rather than being created without one
+		store.Modify(ctx, "3", func(m Member) (Member, error) {
+			m.JobType, m.Role, m.Duration = "Contractor", "", "2 years"
+			return m, nil
+		})
+
+		for _, field := range []string{"role", "duration"} {
+			for _, desc := range []bool{false, true} {
+				keys := memberQuery{Sort: []sortKey{{Field: field, Desc: desc}}}.sortKeys()
+				all, _ := store.List(ctx, memberQuery{Sort: keys})
+				paged := []Member{}
+				var after []string
+				for page := 0; page < len(members)+1; page++ {
+					received, err := store.List(ctx, memberQuery{Sort: keys, After: after, Limit: 1})
+					assert.NoError(t, err, name)
+					if len(received) == 0 {
+						break
+					}
+					paged = append(paged, received...)
+					after = sortPosition(received[0], keys)
+				}
+				assert.Equal(t, joinIDs(all), joinIDs(paged), fmt.Sprintf("%s %s desc=%v", name, field, desc))
+				assert.Len(t, paged, len(members), fmt.Sprintf("%s %s desc=%v", name, field, desc))
+			}
+		}
+		fmt.Println("Successfully paged the " + name + " store by empty fields")
+	}
+}
+
+// Save an empty role or duration in Mongo by removing it, the way Create leaves it out
+func TestMongoFieldsUpdate(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing the Mongo update for empty fields")
+
+	update := fieldsUpdate(bson.D{{Key: "version", Value: 2}}, map[string]interface{}{"jobtype": "Contractor", "role": "", "duration": "2 years"})
+	set, unset := bson.D{}, bson.D{}
+	for _, e := range update {
+		switch e.Key {
+		case "$set":
+			set = e.Value.(bson.D)
+		case "$unset":
+			unset = e.Value.(bson.D)
+		}
+	}
+	assert.ElementsMatch(t, bson.D{{Key: "version", Value: 2}, {Key: "jobtype", Value: "Contractor"}, {Key: "duration", Value: "2 years"}}, set, "They should be the same")
+	ok := assert.Equal(t, bson.D{{Key: "role", Value: ""}}, unset, "They should be the same")
+	if ok {
+		fmt.Println("Successfully removed empty fields instead of saving them")
+	}
+}
+
+// Search each store, and check the index follows changes to members
+func TestStoreSearch(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing searching the MemberStore implementations")
+
+	ctx := context.Background()
+	members := []Member{
+		{ID: "1", FirstName: "Ann", LastName: "Smith", JobType: "Employee", Role: "Team Lead", Tags: []string{"go"}},
+		{ID: "2", FirstName: "Annabel", LastName: "Jones", JobType: "Contractor", Tags: []string{"ann-arbor"}},
+		{ID: "3", FirstName: "Bob", LastName: "Annan", JobType: "Employee", Role: "Lead Engineer", Tags: []string{"go", "remote"}},
+		{ID: "4", FirstName: "Carol", LastName: "Ng", JobType: "Employee", Tags: []string{"anne"}},
+	}
+	// The IDs each search should return, in order
+	searches := []struct {
+		words []string
+		limit int
+		want  string
+	}{
+		// A whole first name counts more than the start of a first or last name, and names more than tags
+		{[]string{"ann"}, 0, "1234"},
+		{[]string{"ann"}, 2, "12"},
+		{[]string{"annabel"}, 0, "2"},
+		{[]string{"lead"}, 0, "13"},
+		{[]string{"ann", "lead"}, 0, "13"},
+		{[]string{"go", "remote"}, 0, "3"},
+		{[]string{"arbor"}, 0, "2"},
+		{[]string{"zoe"}, 0, ""},
+	}
+
+	for name, store := range testStores(t) {
+		for _, m := range members {
+			store.Create(ctx, m)
+		}
+		for _, search := range searches {
+			received, _, err := store.Search(ctx, search.words, search.limit)
+			assert.NoError(t, err, name)
+			assert.Equal(t, search.want, joinIDs(received), fmt.Sprintf("%s %v", name, search.words))
+		}
+
+		// Changed, replaced and deleted members are found by their new words only
+		store.Modify(ctx, "1", func(m Member) (Member, error) {
+			m.FirstName = "Zoe"
+			return m, nil
+		})
+		store.Modify(ctx, "3", func(m Member) (Member, error) {
+			m.Role = ""
+			return m, nil
+		})
+		store.Delete(ctx, "4", 0)
+		received, _, _ := store.Search(ctx, []string{"ann"}, 0)
+		assert.Equal(t, "23", joinIDs(received), name)
+		received, _, _ = store.Search(ctx, []string{"zoe"}, 0)
+		assert.Equal(t, "1", joinIDs(received), name)
+		received, _, _ = store.Search(ctx, []string{"lead"}, 0)
+		assert.Equal(t, "1", joinIDs(received), name)
+
+		store.DeleteAll(ctx)
+		received, _, _ = store.Search(ctx, []string{"zoe"}, 0)
+		assert.Equal(t, "", joinIDs(received), name)
+		fmt.Println("Successfully searched the " + name + " store")
+	}
+}
+
+// Search each store for more members than it ranks, and check it says the search was truncated
+func TestStoreSearchCandidates(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing capping the members a search ranks")
+
+	ctx := context.Background()
+	var members []Member
+	for i := 0; i < maxSearchCandidates+5; i++ {
+		members = append(members, Member{ID: fmt.Sprintf("%04d", i), FirstName: "Ann", LastName: "Smith", JobType: "Contractor", Duration: "1 year"})
+	}
+
+	for name, store := range testStores(t) {
+		// Exactly as many members as are ranked is not truncated
+		store.CreateMany(ctx, members[:maxSearchCandidates], false)
+		received, truncated, err := store.Search(ctx, []string{"an"}, 0)
+		assert.NoError(t, err, name)
+		assert.Len(t, received, maxSearchCandidates, name)
+		assert.False(t, truncated, name)
+
+		store.CreateMany(ctx, members[maxSearchCandidates:], false)
+		received, truncated, _ = store.Search(ctx, []string{"an"}, 0)
+		assert.True(t, truncated, name)
+		ok := assert.Len(t, received, maxSearchCandidates, name)
+		if ok {
+			assert.Equal(t, members[maxSearchCandidates-1].ID, received[len(received)-1].ID, name)
+			fmt.Println("Successfully capped the search of the " + name + " store")
+		}
+	}
+}
+
+// Create many members at once in each store
+func TestStoreCreateMany(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing creating many members in the MemberStore implementations")
+
+	ctx := context.Background()
+	batch := []Member{
+		{ID: "1", FirstName: "Ann", LastName: "Smith", JobType: "Employee", Role: "Team Lead"},
+		{ID: "2", FirstName: "Bob", LastName: "Jones", JobType: "Contractor", Duration: "6 months"},
+		{ID: "1", FirstName: "Carol", LastName: "Ng", JobType: "Employee", Role: "Engineer"},
+		{ID: "3", FirstName: "Dan", LastName: "Lee", JobType: "Employee", Role: "Engineer"},
+	}
+
+	for name, store := range testStores(t) {
+		store.Create(ctx, Member{ID: "3", FirstName: "Eve", LastName: "Park", JobType: "Employee", Role: "Engineer"})
+
+		// All or nothing: the repeated and the taken ID fail the batch, and nothing is saved
+		created, errs, err := store.CreateMany(ctx, batch, true)
+		assert.NoError(t, err, name)
+		assert.Equal(t, []error{nil, nil, errDuplicateID, errDuplicateID}, errs, name)
+		assert.Equal(t, "", joinIDs(created), name)
+		list, _ := store.List(ctx, memberQuery{})
+		assert.Equal(t, "3", joinIDs(list), name)
+
+		// Otherwise the other members are saved
+		created, errs, err = store.CreateMany(ctx, batch, false)
+		assert.NoError(t, err, name)
+		assert.Equal(t, []error{nil, nil, errDuplicateID, errDuplicateID}, errs, name)
+		assert.Equal(t, "12", joinIDs(created), name)
+		assert.Equal(t, int64(1), created[0].Version, name)
+		list, _ = store.List(ctx, memberQuery{})
+		assert.Equal(t, "123", joinIDs(list), name)
+
+		// Saved members can be found
+		received, _ := store.Get(ctx, "1")
+		assert.Equal(t, "Ann", received.FirstName, name)
+		found, _, _ := store.Search(ctx, []string{"bob"}, 0)
+		assert.Equal(t, "2", joinIDs(found), name)
+		fmt.Println("Successfully created many members in the " + name + " store")
+	}
+}
+
+// Delete the members that pass the filters in each store
+func TestStoreDeleteMatching(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing deleting matching members in the MemberStore implementations")
+
+	ctx := context.Background()
+	members := []Member{
+		{ID: "1", FirstName: "Ann", LastName: "Smith", JobType: "Employee", Role: "Team Lead", Tags: []string{"alumni", "go"}},
+		{ID: "2", FirstName: "Bob", LastName: "Jones", JobType: "Contractor", Duration: "6 months", Tags: []string{"alumni"}},
+		{ID: "3", FirstName: "Carol", LastName: "Ng", JobType: "Employee", Role: "Engineer", Tags: []string{"go"}},
+		{ID: "4", FirstName: "Dan", LastName: "Lee", JobType: "Contractor", Duration: "1 year"},
+	}
+
+	for name, store := range testStores(t) {
+		store.CreateMany(ctx, members, false)
+
+		deleted, err := store.DeleteMatching(ctx, memberQuery{JobType: "contractor", Tags: []string{"alumni"}, AllTags: true})
+		assert.NoError(t, err, name)
+		assert.Equal(t, 1, deleted, name)
+		list, _ := store.List(ctx, memberQuery{})
+		assert.Equal(t, "134", joinIDs(list), name)
+
+		// The sort order and page are ignored
+		deleted, _ = store.DeleteMatching(ctx, memberQuery{Tags: []string{"go"}, Sort: []sortKey{{Field: "lastname"}}, Limit: 1})
+		assert.Equal(t, 2, deleted, name)
+		deleted, _ = store.DeleteMatching(ctx, memberQuery{Role: "Engineer"})
+		assert.Equal(t, 0, deleted, name)
+		list, _ = store.List(ctx, memberQuery{})
+		assert.Equal(t, "4", joinIDs(list), name)
+
+		// Deleted members are gone from the search index too
+		found, _, _ := store.Search(ctx, []string{"ann"}, 0)
+		assert.Equal(t, "", joinIDs(found), name)
+		fmt.Println("Successfully deleted matching members in the " + name + " store")
+	}
+}
+
+// Index members that were saved before the search index existed
+func TestSQLIndexTerms(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing indexing existing members in the SQL store")
+
+	ctx := context.Background()
+	store, err := openSQLiteStore(ctx, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Create(ctx, Member{ID: "1", FirstName: "Ann", LastName: "Smith", JobType: "Employee"})
+	store.db.ExecContext(ctx, `DELETE FROM member_terms`)
+
+	received, _, _ := store.Search(ctx, []string{"ann"}, 0)
+	assert.Empty(t, received, "They should be the same")
+	assert.NoError(t, store.indexTerms(ctx))
+	received, _, _ = store.Search(ctx, []string{"ann"}, 0)
+	ok := assert.Equal(t, "1", joinIDs(received), "They should be the same")
+	if ok {
+		fmt.Println("Successfully indexed existing members")
+	}
+}
+
+// Write the queries of the SQL store for each database
+func TestSQLDialects(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing the SQL store's PostgreSQL queries")
+
+	sqlite := &sqlStore{dialect: "sqlite"}
+	postgres := &sqlStore{dialect: "postgres"}
+	query := `UPDATE members SET firstname = ?, modified = ? WHERE clid = ?`
+	assert.Equal(t, query, sqlite.rebind(query), "They should be the same")
+	assert.Equal(t, `UPDATE members SET firstname = $1, modified = $2 WHERE clid = $3`, postgres.rebind(query), "They should be the same")
+
+	// Paging compares bytes in both, as the other stores do
+	q := memberQuery{Sort: []sortKey{{Field: "lastname"}}, After: []string{"Smith", "1"}}
+	where, args := sqlite.queryWhere(q)
+	assert.Equal(t, ` WHERE ((lastname > ?) OR (lastname = ? AND clid > ?))`, where, "They should be the same")
+	assert.Equal(t, []interface{}{"Smith", "Smith", "1"}, args, "They should be the same")
+	where, _ = postgres.queryWhere(q)
+	assert.Equal(t, ` WHERE ((lastname COLLATE "C" > ?) OR (lastname COLLATE "C" = ? AND clid COLLATE "C" > ?))`, where, "They should be the same")
+
+	// How each driver reports a taken primary key
+	assert.True(t, isUniqueViolation(errors.New("constraint failed: UNIQUE constraint failed: members.clid (1555)")))
+	assert.True(t, isUniqueViolation(errors.New(`ERROR: duplicate key value violates unique constraint "members_pkey" (SQLSTATE 23505)`)))
+	ok := assert.False(t, isUniqueViolation(errors.New(`ERROR: relation "members" does not exist (SQLSTATE 42P01)`)))
+	if ok {
+		fmt.Println("Successfully wrote the queries for SQLite and PostgreSQL")
+	}
+}
+
+// The IDs of a list of members, one after the other
+func joinIDs(members []Member) string {
+	ids := ""
+	for _, m := range members {
+		ids += m.ID
+	}
+	return ids
+}
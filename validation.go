@@ -6,239 +6,279 @@
 package main
 
 import (
-	"context"
 	"fmt"
-	"math/rand"
 	"net/http"
-	"strconv"
 	"strings"
-	"time"
-
-	"go.mongodb.org/mongo-driver/bson"
 )
 
-// Validate data provided when creating a member
-func validateMemberData(w http.ResponseWriter, m Member) bool {
-	// If we're going to throw an error, we need the proper Content-Type
-	w.Header().Set("Content-Type", "text/html")
+// A rule the member data breaks, reported to the client by its JSON field name
+type fieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
 
-	// Did the user provide a first name?
-	if m.FirstName == "" {
-		fmt.Fprintf(w, "The member must have a first name")
-		return false
-	}
+// Every rule a member breaks, returned as an error from inside a store's Modify
+type validationErrors []fieldError
 
-	// Did the user provide a last name?
-	if m.LastName == "" {
-		fmt.Fprintf(w, "The member must have a last name")
-		return false
-	}
+func (v validationErrors) Error() string {
+	return "the member data is not valid"
+}
 
-	// Is the provided JobType valid?
-	lcJobType := strings.ToLower(m.JobType)
-	if lcJobType != "contractor" && lcJobType != "employee" {
-		fmt.Fprintf(w, "The job type provided is not valid. Please provide either 'Employee' or 'Contractor'")
-		return false
-	}
+// A condition on another field, such as the job type being contractor. Values compare case-insensitively.
+type condition struct {
+	field string
+	value string
+}
 
-	// Did the user provide both a role and a duration for a member?
-	if m.Role != "" && m.Duration != "" {
-		fmt.Fprintf(w, "A member cannot have both a duration and a role")
-		return false
-	}
+// Every constraint on a single member field, declared once and used for both creates and updates
+type fieldRule struct {
+	// The JSON name of the field, and the name used for it in messages
+	field string
+	label string
 
-	// Did the user provide the right values for a contractor?
-	if lcJobType == "contractor" && m.Role != "" {
-		fmt.Fprintf(w, "A contractor cannot have a role")
-		return false
-	}
+	required bool
+	// The allowed values, if only some are allowed
+	enum []string
+	// Fields that cannot be set together with this one
+	exclusive []string
+	// The field must be set when any of these conditions holds...
+	requiredIf []condition
+	// ...and must not be set when any of these does
+	forbiddenIf []condition
+}
 
-	// Did the user provide a duration for a contractor?
-	if lcJobType == "contractor" && m.Duration == "" {
-		fmt.Fprintf(w, "A contractor must have a duration")
-		return false
+// The rules every member follows. Adding a job type means adding it to the jobtype enum
+// and to the conditions of the fields it requires or forbids.
+var memberRules = []fieldRule{
+	{field: "firstname", label: "first name", required: true},
+	{field: "lastname", label: "last name", required: true},
+	{field: "jobtype", label: "job type", required: true, enum: []string{"Employee", "Contractor"}},
+	{
+		field:       "role",
+		label:       "role",
+		exclusive:   []string{"duration"},
+		requiredIf:  []condition{{"jobtype", "employee"}},
+		forbiddenIf: []condition{{"jobtype", "contractor"}},
+	},
+	{
+		field:       "duration",
+		label:       "duration",
+		requiredIf:  []condition{{"jobtype", "contractor"}},
+		forbiddenIf: []condition{{"jobtype", "employee"}},
+	},
+}
+
+// Find the rule for a field
+func ruleFor(field string) fieldRule {
+	for _, r := range memberRules {
+		if r.field == field {
+			return r
+		}
 	}
+	return fieldRule{field: field, label: field}
+}
 
-	// Did the user provide a duration for an employee?
-	if lcJobType == "employee" && m.Duration != "" {
-		fmt.Fprintf(w, "An employee cannot have a duration")
-		return false
+// The validated fields of a member, keyed by JSON name. An empty value means the field is not set.
+func memberValues(m Member) map[string]string {
+	return map[string]string{
+		"firstname": m.FirstName,
+		"lastname":  m.LastName,
+		"jobtype":   m.JobType,
+		"role":      m.Role,
+		"duration":  m.Duration,
 	}
+}
 
-	// Did the user provide a role for an employee?
-	if lcJobType == "employee" && m.Role == "" {
-		fmt.Fprintf(w, "An employee must have a role")
-		return false
+// "a contractor" or "an employee"
+func withArticle(word string) string {
+	if word != "" && strings.ContainsRune("aeiouAEIOU", rune(word[0])) {
+		return "an " + word
 	}
+	return "a " + word
+}
 
-	// Data is valid. Return Content-Type to application/json
-	w.Header().Set("Content-Type", "application/json")
-	return true
+// Upper-case the first letter of a message
+func sentence(message string) string {
+	return strings.ToUpper(message[:1]) + message[1:]
 }
 
-func validateUpdate(w http.ResponseWriter, filter bson.D, member Member, outcome string) (string, bool) {
-	lcJobType := strings.ToLower(member.JobType)
+// "either 'Employee' or 'Contractor'", or "one of 'A', 'B' or 'C'" for longer lists
+func listValues(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = "'" + v + "'"
+	}
+	if len(quoted) == 1 {
+		return quoted[0]
+	}
+	last := quoted[len(quoted)-1]
+	if len(quoted) == 2 {
+		return "either " + quoted[0] + " or " + last
+	}
+	return "one of " + strings.Join(quoted[:len(quoted)-1], ", ") + " or " + last
+}
 
-	// Did the user update the first name?
-	if member.FirstName != "" {
-		update := bson.D{
-			{"$set", bson.D{{"firstname", member.FirstName}}},
+// The values of a field's enum that a set of conditions on it does not match
+func valuesOutside(field string, conds []condition) []string {
+	var values []string
+	for _, v := range ruleFor(field).enum {
+		matched := false
+		for _, c := range conds {
+			matched = matched || (c.field == field && strings.EqualFold(c.value, v))
 		}
-		_, err := collection.UpdateOne(context.TODO(), filter, update)
-		if err != nil {
-			printErrorMessage(w, err)
-			return "", false
+		if !matched {
+			values = append(values, strings.ToLower(v))
 		}
-		outcome += "Updated first name successfully. "
 	}
+	return values
+}
 
-	// Did the user update the last name?
-	if member.LastName != "" {
-		update := bson.D{
-			{"$set", bson.D{{"lastname", member.LastName}}},
-		}
-		_, err := collection.UpdateOne(context.TODO(), filter, update)
-		if err != nil {
-			printErrorMessage(w, err)
-			return "", false
-		}
-		outcome += "Updated last name successfully. "
+// Evaluate memberRules against a set of values.
+// In a partial evaluation only the provided fields are checked, and a field whose rules depend on
+// another field can only be set when that field is provided too.
+func evaluateRules(values map[string]string, partial bool) []fieldError {
+	var errs []fieldError
+	add := func(field string, rule string, message string) {
+		errs = append(errs, fieldError{Field: field, Rule: rule, Message: message})
 	}
 
-	// Did the user update the job type?
-	// If so, we need to make sure duration and role are handled accordingly
-	if member.JobType != "" {
-		if lcJobType != "contractor" && lcJobType != "employee" {
-			fmt.Fprintf(w, "The job type provided is not valid. Please provide either 'Employee' or 'Contractor'.")
-			return "", false
+	for _, r := range memberRules {
+		value := values[r.field]
+		set := value != ""
+
+		if r.required && !partial && !set {
+			add(r.field, "required", "The member must have "+withArticle(r.label))
 		}
 
-		// If the job type is contractor, a duration must also be specified
-		if lcJobType == "contractor" {
-			if member.Duration == "" {
-				fmt.Fprintf(w, "The contractor job type must have a specified duration.")
-				return "", false
+		if set && len(r.enum) > 0 {
+			valid := false
+			for _, allowed := range r.enum {
+				valid = valid || strings.EqualFold(value, allowed)
 			}
-			update := bson.D{
-				{"$set", bson.D{
-					{"jobtype", member.JobType},
-					{"duration", member.Duration},
-					{"role", ""},
-				}},
+			if !valid {
+				add(r.field, "enum", "The "+r.label+" provided is not valid. Please provide "+listValues(r.enum))
 			}
-			_, err := collection.UpdateOne(context.TODO(), filter, update)
-			if err != nil {
-				printErrorMessage(w, err)
-				return "", false
+		}
+
+		for _, other := range r.exclusive {
+			if set && values[other] != "" {
+				add(r.field, "exclusive", "A member cannot have both "+withArticle(r.label)+" and "+withArticle(ruleFor(other).label))
 			}
-			outcome += "Updated member job type to contractor. "
 		}
 
-		// If the job type is employee, a role must also be specified
-		if lcJobType == "employee" {
-			if member.Role == "" {
-				fmt.Fprintf(w, "The employee job type must have a specified role.")
-				return "", false
+		for _, c := range r.requiredIf {
+			if !set && strings.EqualFold(values[c.field], c.value) {
+				add(r.field, "required", sentence(withArticle(c.value))+" must have "+withArticle(r.label))
 			}
-			update := bson.D{
-				{"$set", bson.D{
-					{"jobtype", member.JobType},
-					{"role", member.Role},
-					{"duration", ""},
-				}},
+		}
+
+		if !set {
+			continue
+		}
+		dependencyReported := false
+		for _, c := range r.forbiddenIf {
+			if partial && values[c.field] == "" {
+				// Without the other field in the update there is nothing to check this one against
+				if !dependencyReported {
+					allowed := strings.Join(valuesOutside(c.field, r.forbiddenIf), " or ")
+					add(c.field, "required", "To set "+withArticle(r.label)+", please also include "+withArticle(ruleFor(c.field).label)+" of "+allowed+".")
+					dependencyReported = true
+				}
+				continue
 			}
-			_, err := collection.UpdateOne(context.TODO(), filter, update)
-			if err != nil {
-				printErrorMessage(w, err)
-				return "", false
+			if strings.EqualFold(values[c.field], c.value) {
+				add(r.field, "forbidden", sentence(withArticle(c.value))+" cannot have "+withArticle(r.label))
 			}
-			outcome += "Updated member job type to employee. "
 		}
 	}
+	return errs
+}
 
-	// Did the user update the role?
-	if member.Role != "" {
-		if lcJobType == "" {
-			fmt.Fprintf(w, "To set a role, please also include a job type of employee.")
-			return "", false
-		}
+// IDs a member cannot have, because a route with the same path would hide it
+var reservedIDs = []string{"search"}
 
-		if lcJobType == "contractor" {
-			fmt.Fprintf(w, "A contractor cannot have a role.")
-			return "", false
-		}
-		update := bson.D{
-			{"$set", bson.D{
-				{"jobtype", member.JobType},
-				{"role", member.Role},
-			}},
-		}
-		_, err := collection.UpdateOne(context.TODO(), filter, update)
-		if err != nil {
-			printErrorMessage(w, err)
-			return "", false
-		}
-		outcome += "Updated role successfully. "
+// Check the data provided when creating a member
+func memberErrors(m Member) []fieldError {
+	errs := evaluateRules(memberValues(m), false)
+	if contains(reservedIDs, m.ID) {
+		errs = append(errs, fieldError{Field: "clid", Rule: "reserved", Message: fmt.Sprintf("The clid %q is reserved, since /api/members/%s is another route", m.ID, m.ID)})
+	}
+	// The clid is the last segment of the member's URL, so it cannot hold a slash or be only spaces
+	if strings.Contains(m.ID, "/") {
+		errs = append(errs, fieldError{Field: "clid", Rule: "format", Message: "The clid cannot contain a /"})
 	}
+	if m.ID != "" && strings.TrimSpace(m.ID) == "" {
+		errs = append(errs, fieldError{Field: "clid", Rule: "format", Message: "The clid cannot be only spaces"})
+	}
+	return errs
+}
 
-	// Did the user update the duration?
-	if member.Duration != "" {
-		if lcJobType == "" {
-			fmt.Fprintf(w, "To set a duration, please also include a job type of contractor.")
-			return "", false
-		}
+// Check the fields provided when updating a member. Empty fields are not being updated.
+func updateErrors(m Member) []fieldError {
+	return evaluateRules(memberValues(m), true)
+}
 
-		if lcJobType == "employee" {
-			fmt.Fprintf(w, "An employee cannot have a duration.")
-			return "", false
-		}
-		update := bson.D{
-			{"$set", bson.D{
-				{"jobtype", member.JobType},
-				{"duration", member.Duration},
-				{"role", ""},
-			}},
-		}
-		_, err := collection.UpdateOne(context.TODO(), filter, update)
-		if err != nil {
-			printErrorMessage(w, err)
-			return "", false
+// Validate data provided when creating a member, reporting every broken rule to the user
+func validateMemberData(w http.ResponseWriter, m Member) bool {
+	if errs := memberErrors(m); len(errs) > 0 {
+		printValidationErrors(w, errs)
+		return false
+	}
+	return true
+}
+
+// Collect the fields provided in a valid update into a single set of changes.
+// Changing the job type clears every field its rules forbid for the new job type, such as the role of a contractor.
+func updateFields(member Member) map[string]interface{} {
+	fields := map[string]interface{}{}
+
+	// Did the user update the first or last name?
+	if member.FirstName != "" {
+		fields["firstname"] = member.FirstName
+	}
+	if member.LastName != "" {
+		fields["lastname"] = member.LastName
+	}
+
+	// Did the user update the job type, and the fields that depend on it?
+	// The rules guarantee those fields only come with a job type that allows them
+	if member.JobType != "" {
+		fields["jobtype"] = member.JobType
+		values := memberValues(member)
+		for _, r := range memberRules {
+			if forbiddenFor(r, "jobtype", member.JobType) {
+				fields[r.field] = ""
+			} else if r.field != "jobtype" && dependsOn(r, "jobtype") && values[r.field] != "" {
+				fields[r.field] = values[r.field]
+			}
 		}
-		outcome += "Updated duration successfully. "
 	}
 
 	// Did the user update or remove the tags?
 	if member.Tags != nil {
-		update := bson.D{
-			{"$set", bson.D{
-				{"tags", member.Tags},
-			}},
-		}
-		_, err := collection.UpdateOne(context.TODO(), filter, update)
-		if err != nil {
-			printErrorMessage(w, err)
-			return "", false
-		}
-		outcome += "Updated tags successfully. "
+		fields["tags"] = member.Tags
 	}
 
-	return outcome, true
+	return fields
 }
 
-// Ensure the  ID doesn't match an existing ID
-func verifyUniqueID(clid string, outcome string) (string, string) {
-	newID := clid
-	filter := bson.D{{"clid", clid}}
-	var testMember Member
-
-	// Test whether or not the given ID matches a member
-	err := collection.FindOne(context.TODO(), filter).Decode(&testMember)
-	if err == nil {
-		rand.Seed(time.Now().UTC().UnixNano())
-		newID = strconv.Itoa(rand.Intn(99999999))
-		outcome = "The provided ID was not unique, so a unique one with number " + newID + " was created. "
-		verifyUniqueID(newID, outcome)
+// Whether a rule forbids its field when another field has the provided value
+func forbiddenFor(r fieldRule, field string, value string) bool {
+	for _, c := range r.forbiddenIf {
+		if c.field == field && strings.EqualFold(c.value, value) {
+			return true
+		}
 	}
+	return false
+}
 
-	return newID, outcome
+// Whether a rule requires or forbids its field depending on another field
+func dependsOn(r fieldRule, field string) bool {
+	for _, c := range append(append([]condition{}, r.requiredIf...), r.forbiddenIf...) {
+		if c.field == field {
+			return true
+		}
+	}
+	return false
 }
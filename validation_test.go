@@ -0,0 +1,59 @@
+/*
+	validation_test.go
+
+		Checks the member rules directly, without going through the router
+*/
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Try adding a new job type by only declaring rules
+func TestRulesNewJobType(t *testing.T) {
+	fmt.Println("----------------")
+	fmt.Println("Testing a job type added to the rules")
+
+	saved := memberRules
+	defer func() { memberRules = saved }()
+
+	// Interns have a duration like contractors, and no role
+	memberRules = []fieldRule{
+		{field: "firstname", label: "first name", required: true},
+		{field: "lastname", label: "last name", required: true},
+		{field: "jobtype", label: "job type", required: true, enum: []string{"Employee", "Contractor", "Intern"}},
+		{field: "role", label: "role", requiredIf: []condition{{"jobtype", "employee"}}, forbiddenIf: []condition{{"jobtype", "contractor"}, {"jobtype", "intern"}}},
+		{field: "duration", label: "duration", requiredIf: []condition{{"jobtype", "contractor"}, {"jobtype", "intern"}}, forbiddenIf: []condition{{"jobtype", "employee"}}},
+	}
+
+	intern := Member{FirstName: "Tiro", LastName: "Tullius", JobType: "Intern", Role: "Scribe"}
+	expected := []fieldError{
+		{Field: "role", Rule: "forbidden", Message: "An intern cannot have a role"},
+		{Field: "duration", Rule: "required", Message: "An intern must have a duration"},
+	}
+	assert.Equal(t, expected, memberErrors(intern), "They should be the same")
+
+	expected = []fieldError{
+		{Field: "jobtype", Rule: "required", Message: "To set a role, please also include a job type of employee."},
+	}
+	assert.Equal(t, expected, updateErrors(Member{Role: "Scribe"}), "They should be the same")
+
+	expected = []fieldError{
+		{Field: "jobtype", Rule: "enum", Message: "The job type provided is not valid. Please provide one of 'Employee', 'Contractor' or 'Intern'"},
+	}
+	assert.Equal(t, expected, updateErrors(Member{JobType: "Gladiator"}), "They should be the same")
+
+	intern.Role, intern.Duration = "", "1 summer"
+	assert.Empty(t, memberErrors(intern))
+
+	// Becoming an intern sets the duration and clears the role, as the rules say
+	expectedFields := map[string]interface{}{"jobtype": "Intern", "duration": "1 summer", "role": ""}
+	ok := assert.Equal(t, expectedFields, updateFields(Member{JobType: "Intern", Duration: "1 summer"}), "They should be the same")
+	if ok {
+		fmt.Println("Successfully validated a new job type from its rules alone")
+	}
+}